@@ -19,15 +19,18 @@ package controller // import "orcastack.io/common/watch-operator/pkg/controller"
 
 import (
 	"context"
+	"errors"
+	"github.com/go-logr/logr"
 	"github.com/wangguoyan/mc-operator/pkg/cluster"
 	"github.com/wangguoyan/mc-operator/pkg/handler"
 	"github.com/wangguoyan/mc-operator/pkg/manager"
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
 	"github.com/wangguoyan/mc-operator/pkg/reconcile"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"log"
-	"os"
+	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sync"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -42,31 +45,87 @@ import (
 // e.g., on resource CRUD events in a cluster. The Requests are processed by the user-provided Reconciler.
 // A Controller can watch multiple resources in multiple clusters. It saves those clusters in a set,
 // so the Manager knows which caches to start and sync before starting the Controller.
+// Clusters can be attached to a running Controller with the Watch methods, and detached with DetachCluster,
+// so a single Controller, with a single queue and pool of workers, can serve a changing set of clusters.
 type Controller struct {
-	reconciler reconcile.Reconciler
+	reconciler reconcile.ContextReconciler
 	clusters   []manager.Cache
+	// watched maps the names of the watched clusters to the cluster and the context it is watched with.
+	watched map[string]watchedCluster
+	mu      sync.RWMutex
+	panics  panicTracker
+	// failures maps the Requests that failed to the number of times they failed in a row.
+	failures   map[interface{}]int
+	failuresMu sync.Mutex
+	drain      drainTracker
+	// held maps the held clusters to their Requests set aside until they are released.
+	held map[cluster.ClusterCache]map[reconcile.Key]struct{}
 	Options
 }
 
+// watchedCluster is a cluster attached to a Controller.
+type watchedCluster struct {
+	cluster cluster.ClusterCache
+	ctx     context.Context
+}
+
 // Options is used as an argument of New.
 type Options struct {
-	// JitterPeriod is the time to wait after an error to start working again.
+	// JitterPeriod is the time to wait before restarting a control loop that stopped.
 	JitterPeriod time.Duration
 	// MaxConcurrentReconciles is the number of concurrent control loops.
 	// Use this if your Reconciler is slow, but thread safe.
 	MaxConcurrentReconciles int
-	// Queue can be used to override the default queue.
+	// Queue can be used to override the default queue, built with NewQueue.
 	Queue workqueue.RateLimitingInterface
-	// Logger can be used to override the default logger.
-	Logger *log.Logger
+	// RateLimiter is the rate limiter of the default queue. Defaults to workqueue.DefaultControllerRateLimiter().
+	// It is ignored if Queue is set.
+	RateLimiter workqueue.RateLimiter
+	// Logger can be used to override the default logger, klog.Background().
+	// Each reconcile gets a logger derived from it, with the cluster, namespace and name of its Request.
+	Logger logr.Logger
+	// ReconcileTimeout is the timeout of the context of each reconcile.
+	// If unset (ReconcileTimeout == 0), reconciles have no timeout.
+	// In the ControllerOptions of a job.WatchResource, it is overridden by WatchResource.ReconcileTimeout,
+	// and both are overridden by the ReconcileTimeout set on the cluster with job.WithControllerOptions.
+	ReconcileTimeout time.Duration
+	// Kind is the kind of the reconciled resource, used to label the metrics.
+	Kind string
+	// RecoverPanic makes the Controller recover the panics of the reconciler: their stack is logged,
+	// they are counted in metrics.ReconcilePanics, and their Request is requeued with backoff. Defaults to true.
+	RecoverPanic *bool
+	// QuarantinePolicy quarantines the clusters whose reconciler keeps panicking.
+	// If unset, clusters are never quarantined.
+	QuarantinePolicy *QuarantinePolicy
+	// GracePeriod is how long the running reconciles of a cluster may go on once the cluster is stopped,
+	// or once the Controller is stopped, before their contexts are cancelled. Defaults to 30 seconds.
+	// A negative GracePeriod cancels them right away.
+	GracePeriod time.Duration
 }
 
-// New creates a new Controller.
+// New creates a new Controller for a Reconciler, which ignores the reconcile contexts.
 func New(r reconcile.Reconciler, o Options) *Controller {
+	return NewWithContext(reconcile.AsContextReconciler(r), o)
+}
+
+// NewWithContext creates a new Controller for a ContextReconciler.
+func NewWithContext(r reconcile.ContextReconciler, o Options) *Controller {
 	c := &Controller{
 		reconciler: r,
 		clusters:   nil,
-		Options:    o,
+		watched:    map[string]watchedCluster{},
+		panics: panicTracker{
+			panics: map[string][]time.Time{},
+			until:  map[string]time.Time{},
+		},
+		failures: map[interface{}]int{},
+		held:     map[cluster.ClusterCache]map[reconcile.Key]struct{}{},
+		drain: drainTracker{
+			inflight:  map[string]map[reconcile.Key]struct{}{},
+			changed:   make(chan struct{}),
+			abandoned: map[string][]reconcile.Key{},
+		},
+		Options: o,
 	}
 
 	if c.JitterPeriod == 0 {
@@ -77,17 +136,45 @@ func New(r reconcile.Reconciler, o Options) *Controller {
 		c.MaxConcurrentReconciles = 1
 	}
 
+	if c.GracePeriod == 0 {
+		c.GracePeriod = defaultGracePeriod
+	}
+
+	if c.RateLimiter == nil {
+		c.RateLimiter = workqueue.DefaultControllerRateLimiter()
+	}
+
 	if c.Queue == nil {
-		c.Queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		c.Queue = NewQueue(c.RateLimiter, c.Kind)
+	}
+
+	if c.Logger.GetSink() == nil {
+		c.Logger = klog.Background()
 	}
 
-	if c.Logger == nil {
-		c.Logger = log.New(os.Stdout, "", log.Lshortfile)
+	if c.QuarantinePolicy != nil {
+		p := *c.QuarantinePolicy
+		if p.MaxPanics <= 0 {
+			p.MaxPanics = 5
+		}
+		if p.Window <= 0 {
+			p.Window = time.Minute
+		}
+		if p.Duration <= 0 {
+			p.Duration = 5 * time.Minute
+		}
+		c.QuarantinePolicy = &p
 	}
 
 	return c
 }
 
+// NewQueue creates a rate limiting queue recording the workqueue metrics of the Requests of kind.
+func NewQueue(rl workqueue.RateLimiter, kind string) workqueue.RateLimitingInterface {
+	q := metrics.NewQueue(workqueue.New(), kind)
+	return workqueue.NewRateLimitingQueueWithDelayingInterface(workqueue.NewDelayingQueueWithCustomQueue(q, ""), rl)
+}
+
 // WatchOptions is used as an argument of WatchResource methods to filter events *on the client side*.
 // You can filter on the server side with cluster.Options.
 type WatchOptions struct {
@@ -152,68 +239,314 @@ func (c *Controller) WatchResourceReconcileObject(ctx context.Context, cluster c
 	return c.WatchResource(ctx, cluster, objectType, h)
 }
 
+// WatchResourceReconcileMapFunc configures the Controller to watch resources of the same Kind as objectType,
+// in the specified cluster, generating reconcile Requests from the Keys mapFunc returns for the watched objects.
+// The Requests are always for the same cluster, whatever the ClusterName of the Keys.
+func (c *Controller) WatchResourceReconcileMapFunc(ctx context.Context, cluster cluster.ClusterCache, objectType client.Object, mapFunc handler.MapFunc, o WatchOptions) error {
+	h := &handler.EnqueueRequestsFromMapFunc{Cluster: cluster, Queue: c.Queue, ToRequests: mapFunc, Filter: o.Filter, Predicates: o.Predicates}
+	return c.WatchResource(ctx, cluster, objectType, h)
+}
+
 // WatchResource configures the Controller to watch resources of the same Kind as objectType,
 // in the specified cluster, generating reconcile Requests an arbitrary ResourceEventHandler.
+// The Requests of the cluster are reconciled with contexts derived from ctx.
 func (c *Controller) WatchResource(ctx context.Context, cluster cluster.ClusterCache, objectType client.Object, h cache.ResourceEventHandler) error {
+	c.mu.Lock()
 	c.clusters = append(c.clusters, cluster)
+	c.watched[cluster.GetClusterName()] = watchedCluster{cluster: cluster, ctx: ctx}
+	c.mu.Unlock()
 	return cluster.AddEventHandler(ctx, objectType, h)
 }
 
+// DetachCluster stops reconciling the Requests of the given cluster. The Requests of the cluster
+// that are still queued or held are dropped. Stopping the cluster's cache is up to the caller.
+// It does nothing if the cluster was replaced by another one with the same name in the meantime.
+// Use DrainCluster to wait for the running reconciles of the cluster.
+func (c *Controller) DetachCluster(cl cluster.ClusterCache) {
+	c.detach(cl)
+}
+
+// detach detaches the cluster, and reports whether it was still watched, with its held Requests.
+func (c *Controller) detach(cl cluster.ClusterCache) (bool, []reconcile.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := cl.GetClusterName()
+	detached := false
+	if wc, ok := c.watched[name]; ok && wc.cluster == cl {
+		delete(c.watched, name)
+		c.ReleaseCluster(name)
+		c.forgetCluster(name)
+		detached = true
+	}
+	var held []reconcile.Key
+	for key := range c.held[cl] {
+		held = append(held, key)
+	}
+	delete(c.held, cl)
+	clusters := c.clusters[:0]
+	for i := range c.clusters {
+		if c.clusters[i] != manager.Cache(cl) {
+			clusters = append(clusters, c.clusters[i])
+		}
+	}
+	for i := len(clusters); i < len(c.clusters); i++ {
+		c.clusters[i] = nil
+	}
+	c.clusters = clusters
+	return detached, held
+}
+
+// HoldCluster holds the Requests of the given cluster: they are set aside instead of being reconciled,
+// until ReleaseHeldCluster is called. Attaching a cluster to a running Controller, its Requests can be held
+// until its cache is synced, so its reconciles do not see a partial cache.
+func (c *Controller) HoldCluster(cl cluster.ClusterCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.held[cl]; !ok {
+		c.held[cl] = map[reconcile.Key]struct{}{}
+	}
+}
+
+// ReleaseHeldCluster stops holding the Requests of the given cluster, and queues those held so far.
+func (c *Controller) ReleaseHeldCluster(cl cluster.ClusterCache) {
+	c.mu.Lock()
+	held, ok := c.held[cl]
+	delete(c.held, cl)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	for key := range held {
+		c.Queue.Add(key)
+	}
+}
+
+// hold sets key aside if cl is held, and reports whether it did.
+func (c *Controller) hold(cl cluster.ClusterCache, key reconcile.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	held, ok := c.held[cl]
+	if ok {
+		held[key] = struct{}{}
+	}
+	return ok
+}
+
 // GetCaches gets the current set of clusters (which implement manager.Cache) watched by the Controller.
 // Manager uses this to ensure the necessary caches are started and synced before it starts the Controller.
 func (c *Controller) GetCaches() []manager.Cache {
-	return c.clusters
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]manager.Cache(nil), c.clusters...)
+}
+
+// GetCluster returns the watched cluster with the given name. The Requests of the cluster are resolved with it.
+func (c *Controller) GetCluster(clusterName string) (cluster.ClusterCache, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	wc, ok := c.watched[clusterName]
+	return wc.cluster, ok
+}
+
+// reconcileContext returns the context to reconcile a Request of the given cluster with, and the cluster.
+// It has the values of the context the cluster is watched with,
+// and is cancelled GracePeriod after that context is done.
+// It returns false if the cluster is not watched by the Controller (anymore).
+func (c *Controller) reconcileContext(clusterName string) (context.Context, context.CancelFunc, cluster.ClusterCache, bool) {
+	c.mu.RLock()
+	wc, ok := c.watched[clusterName]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, nil, nil, false
+	}
+	ctx, cancel := drainContext(wc.ctx, c.gracePeriod())
+	if c.ReconcileTimeout > 0 {
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, c.ReconcileTimeout)
+		return timeoutCtx, func() {
+			timeoutCancel()
+			cancel()
+		}, wc.cluster, true
+	}
+	return ctx, cancel, wc.cluster, true
 }
 
 // Start starts the Controller's control loops (as many as MaxConcurrentReconciles) in separate channels
-// and blocks until an empty struct is sent to the stop channel.
+// and blocks until ctx is done. It then shuts the queue down and waits for the running reconciles to finish,
+// for at most GracePeriod. The Requests still queued, and those still reconciled after GracePeriod,
+// are abandoned; they are returned by TakeAbandoned.
 func (c *Controller) Start(ctx context.Context) error {
-	defer c.Queue.ShutDown()
-
+	var workers sync.WaitGroup
 	for i := 0; i < c.MaxConcurrentReconciles; i++ {
-		go wait.Until(func() {
-			for c.processNextWorkItem() {
-			}
-		}, c.JitterPeriod, ctx.Done())
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(func() {
+				for c.processNextWorkItem(ctx) {
+				}
+			}, c.JitterPeriod, ctx.Done())
+		}()
 	}
 
 	<-ctx.Done()
+	c.Queue.ShutDown()
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	timer := time.NewTimer(c.gracePeriod())
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		running := c.drain.running(func(string) bool { return true })
+		for i := range running {
+			c.drain.abandon(running[i].ClusterName, running[i])
+		}
+		c.Logger.Info("Grace period expired, abandon running reconciles", "count", len(running))
+	}
 	return nil
 }
 
-func (c *Controller) processNextWorkItem() bool {
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 	obj, shutdown := c.Queue.Get()
 	if obj == nil {
 		c.Queue.Forget(obj)
 	}
 
 	if shutdown {
-		c.Logger.Print("Shutting down. Ignore work item and stop working.")
+		c.Logger.V(1).Info("Shutting down, ignore work item and stop working")
 		return false
 	}
 
 	defer c.Queue.Done(obj)
-	var req reconcile.Request
+	var key reconcile.Key
 	var ok bool
-	if req, ok = obj.(reconcile.Request); !ok {
-		c.Logger.Print("Work item is not a Request. Ignore it. Next.")
-		c.Queue.Forget(obj)
+	if key, ok = obj.(reconcile.Key); !ok {
+		c.Logger.Info("Work item is not a reconcile Key, ignore it", "item", obj)
+		c.forget(obj)
 		return true
 	}
 
-	if result, err := c.reconciler.Reconcile(req); err != nil {
-		c.Logger.Print(err)
-		c.Logger.Print("Could not reconcile Request. Stop working.")
-		c.Queue.AddRateLimited(req)
-		return false
+	clusterName := key.ClusterName
+	logger := c.Logger.WithValues("cluster", clusterName, "namespace", key.Namespace, "name", key.Name)
+	if !key.GroupVersionKind.Empty() {
+		logger = logger.WithValues("gvk", key.GroupVersionKind)
+	}
+	if ctx.Err() != nil {
+		logger.V(1).Info("Controller is stopped, abandon queued Request")
+		c.drain.abandon(clusterName, key)
+		c.forget(obj)
+		return true
+	}
+	reconcileCtx, cancel, cl, ok := c.reconcileContext(clusterName)
+	if !ok {
+		logger.V(1).Info("Cluster is no longer watched, ignore its Request")
+		c.forget(obj)
+		return true
+	}
+	defer cancel()
+	if c.hold(cl, key) {
+		logger.V(1).Info("Cluster is held, set its Request aside")
+		return true
+	}
+	if until, quarantined := c.Quarantined(clusterName); quarantined {
+		logger.V(1).Info("Cluster is quarantined, requeue its Request", "until", until)
+		c.Queue.AddAfter(key, time.Until(until))
+		return true
+	}
+	reconcileCtx = logr.NewContext(reconcileCtx, logger)
+	start := time.Now()
+	c.drain.begin(clusterName, key)
+	result, err := c.reconcile(reconcileCtx, reconcile.Request{Key: key, Cluster: cl})
+	c.drain.end(clusterName, key)
+	metrics.ReconcileDuration.WithLabelValues(clusterName, c.Kind).Observe(time.Since(start).Seconds())
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		logger.Error(err, "Observed a panic in reconciler", "stack", string(panicErr.Stack))
+		metrics.ReconcilePanics.WithLabelValues(clusterName, c.Kind).Inc()
+		c.recordReconcile(clusterName, metrics.ResultError, true)
+		c.failed(key)
+		if until, quarantined := c.recordPanic(clusterName); quarantined {
+			logger.Error(nil, "Reconciler keeps panicking, quarantine cluster", "until", until)
+		}
+		c.Queue.AddRateLimited(key)
+		return true
+	} else if err != nil {
+		c.handleError(logger, key, err)
+		return true
 	} else if result.RequeueAfter > 0 {
-		c.Queue.AddAfter(req, result.RequeueAfter)
+		c.recordReconcile(clusterName, metrics.ResultRequeueAfter, true)
+		c.Queue.AddAfter(key, result.RequeueAfter)
 		return true
 	} else if result.Requeue {
-		c.Queue.AddRateLimited(req)
+		c.recordReconcile(clusterName, metrics.ResultRequeue, true)
+		c.Queue.AddRateLimited(key)
 		return true
 	}
 
-	c.Queue.Forget(obj)
+	c.recordReconcile(clusterName, metrics.ResultSuccess, false)
+	c.forget(obj)
 	return true
 }
+
+// handleError requeues a Request whose reconcile failed with err, unless err is terminal:
+// after the delay set by err with reconcile.RetryAfter or reconcile.Retryable, or with the rate limiter of the queue.
+func (c *Controller) handleError(logger logr.Logger, key reconcile.Key, err error) {
+	clusterName := key.ClusterName
+	if reconcile.IsTerminal(err) {
+		logger.Error(err, "Could not reconcile Request, do not retry")
+		c.recordReconcile(clusterName, metrics.ResultTerminalError, false)
+		c.forget(key)
+		return
+	}
+	c.recordReconcile(clusterName, metrics.ResultError, true)
+	failures := c.failed(key)
+	if d, ok := reconcile.RetryDelay(err, failures); ok {
+		logger.Error(err, "Could not reconcile Request, retry later", "after", d, "failures", failures)
+		c.Queue.AddAfter(key, d)
+		return
+	}
+	logger.Error(err, "Could not reconcile Request, retry with backoff", "failures", failures)
+	c.Queue.AddRateLimited(key)
+}
+
+// failed records a failure of the Request, and returns the number of times it failed in a row.
+func (c *Controller) failed(item interface{}) int {
+	c.failuresMu.Lock()
+	defer c.failuresMu.Unlock()
+	c.failures[item]++
+	return c.failures[item]
+}
+
+// forget stops tracking the Request, in the rate limiter of the queue and in the failure counts.
+func (c *Controller) forget(item interface{}) {
+	c.failuresMu.Lock()
+	delete(c.failures, item)
+	c.failuresMu.Unlock()
+	c.Queue.Forget(item)
+}
+
+// forgetCluster stops tracking the failed Requests of the cluster, which are no longer retried once it is detached.
+func (c *Controller) forgetCluster(clusterName string) {
+	c.failuresMu.Lock()
+	var forgotten []interface{}
+	for item := range c.failures {
+		if key, ok := item.(reconcile.Key); ok && key.ClusterName == clusterName {
+			delete(c.failures, item)
+			forgotten = append(forgotten, item)
+		}
+	}
+	c.failuresMu.Unlock()
+	for _, item := range forgotten {
+		c.Queue.Forget(item)
+	}
+}
+
+// recordReconcile records the result of a reconcile, and whether its Request is requeued with a delay.
+func (c *Controller) recordReconcile(clusterName, result string, retry bool) {
+	metrics.ReconcileTotal.WithLabelValues(clusterName, c.Kind, result).Inc()
+	if retry {
+		metrics.WorkqueueRetries.WithLabelValues(clusterName, c.Kind).Inc()
+	}
+}
@@ -0,0 +1,407 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgocache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fakeCluster is a cluster without cache: the tests add the Requests to the queues themselves,
+// or call the event handler added to the cluster.
+type fakeCluster struct {
+	name    string
+	mu      sync.Mutex
+	handler clientgocache.ResourceEventHandler
+}
+
+func (c *fakeCluster) GetClusterName() string {
+	return c.name
+}
+
+func (c *fakeCluster) AddEventHandler(_ context.Context, _ client.Object, h clientgocache.ResourceEventHandler) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handler = h
+	return nil
+}
+
+// add calls the event handler of the cluster for an added object.
+func (c *fakeCluster) add(obj interface{}) {
+	c.mu.Lock()
+	h := c.handler
+	c.mu.Unlock()
+	h.OnAdd(obj)
+}
+
+func (c *fakeCluster) GetDelegatingClient() (*client.Client, error) {
+	return nil, nil
+}
+
+func (c *fakeCluster) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (c *fakeCluster) WaitForCacheSync(context.Context) bool {
+	return true
+}
+
+// recordingReconciler records the Requests it reconciles, and returns the result of its func, if any.
+type recordingReconciler struct {
+	mu         sync.Mutex
+	reconciled []reconcile.Request
+	reconcile  func(req reconcile.Request, calls int) (reconcile.Result, error)
+	notify     chan reconcile.Request
+}
+
+func newRecordingReconciler() *recordingReconciler {
+	return &recordingReconciler{notify: make(chan reconcile.Request, 100)}
+}
+
+func (r *recordingReconciler) Reconcile(_ context.Context, req reconcile.Request) (reconcile.Result, error) {
+	r.mu.Lock()
+	r.reconciled = append(r.reconciled, req)
+	calls := 0
+	for i := range r.reconciled {
+		if r.reconciled[i].Key == req.Key {
+			calls++
+		}
+	}
+	f := r.reconcile
+	r.mu.Unlock()
+	defer func() {
+		r.notify <- req
+	}()
+	if f != nil {
+		return f(req, calls)
+	}
+	return reconcile.Result{}, nil
+}
+
+// next returns the next reconciled Request, failing the test if there is none in time.
+func (r *recordingReconciler) next(t testing.TB) reconcile.Request {
+	t.Helper()
+	select {
+	case req := <-r.notify:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a reconcile")
+		return reconcile.Request{}
+	}
+}
+
+// none fails the test if a Request is reconciled within d.
+func (r *recordingReconciler) none(t testing.TB, d time.Duration) {
+	t.Helper()
+	select {
+	case req := <-r.notify:
+		t.Fatalf("unexpected reconcile of %v", req.Key)
+	case <-time.After(d):
+	}
+}
+
+func testKey(cluster, name string) reconcile.Key {
+	return reconcile.Key{ClusterName: cluster, NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+}
+
+// startController starts c with the given clusters attached, until the test ends.
+func startController(t testing.TB, c *Controller, clusters ...*fakeCluster) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, cl := range clusters {
+		if err := c.WatchResourceReconcileObject(ctx, cl, &corev1.Pod{}, WatchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestHoldCluster(t *testing.T) {
+	r := newRecordingReconciler()
+	c := NewWithContext(r, Options{GracePeriod: -1})
+	a, b := &fakeCluster{name: "a"}, &fakeCluster{name: "b"}
+	c.HoldCluster(a)
+	startController(t, c, a, b)
+
+	c.Queue.Add(testKey("a", "x"))
+	c.Queue.Add(testKey("a", "x"))
+	c.Queue.Add(testKey("b", "y"))
+	if req := r.next(t); req.Key != testKey("b", "y") {
+		t.Fatalf("reconciled %v, want only the Requests of the cluster that is not held", req.Key)
+	}
+	r.none(t, 50*time.Millisecond)
+
+	c.ReleaseHeldCluster(a)
+	req := r.next(t)
+	if req.Key != testKey("a", "x") || req.Cluster != a {
+		t.Fatalf("reconciled %v, want the held Request", req.Key)
+	}
+	r.none(t, 50*time.Millisecond)
+}
+
+func TestDrainHeldCluster(t *testing.T) {
+	r := newRecordingReconciler()
+	c := NewWithContext(r, Options{GracePeriod: -1})
+	a := &fakeCluster{name: "a"}
+	c.HoldCluster(a)
+	startController(t, c, a)
+
+	c.Queue.Add(testKey("a", "x"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.RLock()
+		n := len(c.held[a])
+		c.mu.RUnlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the Request was not held")
+		}
+	}
+	if abandoned := c.DrainCluster(a); len(abandoned) != 1 || abandoned[0] != testKey("a", "x") {
+		t.Errorf("abandoned %v, want the held Request", abandoned)
+	}
+	c.ReleaseHeldCluster(a)
+	r.none(t, 50*time.Millisecond)
+}
+
+func TestReconcileErrors(t *testing.T) {
+	failure := errors.New("failure")
+	for _, tc := range []struct {
+		name string
+		// fails is the number of times the Request fails before it is reconciled,
+		// reconciles the number of times it is reconciled in all.
+		fails, reconciles int
+		err               func() error
+		panics            bool
+		minDelay          time.Duration
+		failures          []int
+	}{
+		{name: "terminal", fails: 1, reconciles: 1, err: func() error { return reconcile.Terminal(failure) }},
+		{name: "retry after", fails: 1, reconciles: 2, err: func() error { return reconcile.RetryAfter(failure, 100*time.Millisecond) },
+			minDelay: 100 * time.Millisecond},
+		{name: "retry after zero", fails: 2, reconciles: 3, err: func() error { return reconcile.RetryAfter(failure, 0) }},
+		{name: "retryable", fails: 2, reconciles: 3, failures: []int{1, 2}},
+		{name: "retryable without backoff", fails: 2, reconciles: 3, err: func() error { return reconcile.Retryable(failure, nil) }},
+		{name: "rate limited", fails: 2, reconciles: 3, err: func() error { return failure }},
+		{name: "panic", fails: 1, reconciles: 2, panics: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var failures []int
+			if tc.failures != nil {
+				tc.err = func() error {
+					return reconcile.Retryable(failure, func(n int) time.Duration {
+						mu.Lock()
+						failures = append(failures, n)
+						mu.Unlock()
+						return 10 * time.Millisecond
+					})
+				}
+			}
+			r := newRecordingReconciler()
+			r.reconcile = func(req reconcile.Request, calls int) (reconcile.Result, error) {
+				if req.Key.Name != "x" || calls > tc.fails {
+					return reconcile.Result{}, nil
+				}
+				if tc.panics {
+					panic("reconciler panics")
+				}
+				return reconcile.Result{}, tc.err()
+			}
+			// a single worker, which would not be restarted in time if an error stopped it
+			c := NewWithContext(r, Options{
+				JitterPeriod: time.Hour,
+				RateLimiter:  workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second),
+				GracePeriod:  -1,
+			})
+			a := &fakeCluster{name: "a"}
+			startController(t, c, a)
+
+			c.Queue.Add(testKey("a", "x"))
+			start := time.Now()
+			if req := r.next(t); req.Key != testKey("a", "x") {
+				t.Fatalf("reconciled %v", req.Key)
+			}
+			c.Queue.Add(testKey("a", "y"))
+			if req := r.next(t); req.Key != testKey("a", "y") {
+				t.Fatalf("reconciled %v, want the worker to go on after the failure", req.Key)
+			}
+			for i := 1; i < tc.reconciles; i++ {
+				if req := r.next(t); req.Key != testKey("a", "x") {
+					t.Fatalf("reconciled %v, want the failed Request retried", req.Key)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < tc.minDelay {
+				t.Errorf("retried after %s, want at least %s", elapsed, tc.minDelay)
+			}
+			r.none(t, 100*time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(failures) != fmt.Sprint(tc.failures) {
+				t.Errorf("backoff called with %v failures, want %v", failures, tc.failures)
+			}
+		})
+	}
+}
+
+func TestDetachForgetsFailures(t *testing.T) {
+	r := newRecordingReconciler()
+	r.reconcile = func(reconcile.Request, int) (reconcile.Result, error) {
+		return reconcile.Result{}, reconcile.RetryAfter(errors.New("failure"), time.Hour)
+	}
+	c := NewWithContext(r, Options{GracePeriod: -1})
+	a, b := &fakeCluster{name: "a"}, &fakeCluster{name: "b"}
+	startController(t, c, a, b)
+
+	c.Queue.Add(testKey("a", "x"))
+	c.Queue.Add(testKey("b", "y"))
+	r.next(t)
+	r.next(t)
+	failures := func() map[interface{}]int {
+		c.failuresMu.Lock()
+		defer c.failuresMu.Unlock()
+		copied := map[interface{}]int{}
+		for item, n := range c.failures {
+			copied[item] = n
+		}
+		return copied
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(failures()) != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("failures %v, want both Requests", failures())
+		}
+	}
+
+	c.DetachCluster(a)
+	if got := failures(); len(got) != 1 || got[testKey("b", "y")] != 1 {
+		t.Errorf("failures %v after detaching a, want only those of b", got)
+	}
+}
+
+func TestSameClusterNameSingleReconcile(t *testing.T) {
+	r := newRecordingReconciler()
+	c := NewWithContext(r, Options{GracePeriod: -1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the cache of cluster a is replaced, e.g. after its connection info changed
+	previous, current := &fakeCluster{name: "a"}, &fakeCluster{name: "a"}
+	for _, cl := range []*fakeCluster{previous, current} {
+		if err := c.WatchResourceReconcileObject(ctx, cl, &corev1.Pod{}, WatchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "x"}}
+	previous.add(pod)
+	current.add(pod)
+	if n := c.Queue.Len(); n != 1 {
+		t.Fatalf("%d queued Requests, want the events of both caches merged", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	if req := r.next(t); req.Key != testKey("a", "x") || req.Cluster != current {
+		t.Fatalf("reconciled %v in cluster %p, want the current cache %p", req.Key, req.Cluster, current)
+	}
+	r.none(t, 50*time.Millisecond)
+
+	// a late event of the previous cache is reconciled with the current one
+	previous.add(pod)
+	if req := r.next(t); req.Cluster != current {
+		t.Fatalf("reconciled in cluster %p, want the current cache %p", req.Cluster, current)
+	}
+	// detaching the previous cache does not detach the cluster
+	c.DetachCluster(previous)
+	current.add(pod)
+	if req := r.next(t); req.Cluster != current {
+		t.Fatalf("reconciled in cluster %p, want the current cache %p", req.Cluster, current)
+	}
+}
+
+// benchmarkControllers starts the controllers of resources resources in clusters clusters,
+// like a job with or without shared controllers, reconciles a Request of each cluster,
+// and reports the goroutines the controllers run.
+func benchmarkControllers(b *testing.B, clusters, resources int, shared bool) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		before := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		var reconciled sync.WaitGroup
+		reconciled.Add(clusters * resources)
+		r := reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+			reconciled.Done()
+			return reconcile.Result{}, nil
+		})
+		start := func(c *Controller) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = c.Start(ctx)
+			}()
+		}
+
+		for res := 0; res < resources; res++ {
+			var sharedController *Controller
+			if shared {
+				sharedController = NewWithContext(r, Options{MaxConcurrentReconciles: 8, Queue: NewClusterFairQueue(FairQueueOptions{})})
+				start(sharedController)
+			}
+			for cl := 0; cl < clusters; cl++ {
+				fc := &fakeCluster{name: fmt.Sprintf("cluster-%d", cl)}
+				c := sharedController
+				if !shared {
+					c = NewWithContext(r, Options{})
+				}
+				if err := c.WatchResourceReconcileObject(ctx, fc, &corev1.Pod{}, WatchOptions{}); err != nil {
+					b.Fatal(err)
+				}
+				if !shared {
+					start(c)
+				}
+				c.Queue.Add(testKey(fc.name, "x"))
+			}
+		}
+		reconciled.Wait()
+		b.ReportMetric(float64(runtime.NumGoroutine()-before), "goroutines")
+		cancel()
+		wg.Wait()
+	}
+}
+
+// BenchmarkPerClusterControllers runs a controller per resource and cluster, the default of a job.
+func BenchmarkPerClusterControllers(b *testing.B) {
+	benchmarkControllers(b, 150, 8, false)
+}
+
+// BenchmarkSharedControllers runs a controller per resource shared by every cluster, like WithSharedControllers.
+func BenchmarkSharedControllers(b *testing.B) {
+	benchmarkControllers(b, 150, 8, true)
+}
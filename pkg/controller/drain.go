@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"context"
+	"github.com/wangguoyan/mc-operator/pkg/cluster"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"sync"
+	"time"
+)
+
+// defaultGracePeriod is the default of Options.GracePeriod.
+const defaultGracePeriod = 30 * time.Second
+
+// ClusterDropper is implemented by the queues that can remove the Requests of a cluster, like ClusterFairQueue.
+type ClusterDropper interface {
+	DropCluster(cluster string) []interface{}
+}
+
+// drainTracker records the Requests being reconciled, and those abandoned when their cluster stopped.
+type drainTracker struct {
+	mu sync.Mutex
+	// inflight maps cluster names to the Requests of the cluster being reconciled.
+	inflight map[string]map[reconcile.Key]struct{}
+	// changed is closed, and replaced, every time a reconcile ends.
+	changed   chan struct{}
+	abandoned map[string][]reconcile.Key
+}
+
+// begin records that a reconcile of req started.
+func (t *drainTracker) begin(clusterName string, key reconcile.Key) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inflight[clusterName] == nil {
+		t.inflight[clusterName] = map[reconcile.Key]struct{}{}
+	}
+	t.inflight[clusterName][key] = struct{}{}
+}
+
+// end records that a reconcile of req ended.
+func (t *drainTracker) end(clusterName string, key reconcile.Key) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inflight[clusterName], key)
+	if len(t.inflight[clusterName]) == 0 {
+		delete(t.inflight, clusterName)
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// abandon records Requests that will not be reconciled, or whose reconcile was cut off.
+func (t *drainTracker) abandon(clusterName string, keys ...reconcile.Key) {
+	if len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.abandoned[clusterName] = append(t.abandoned[clusterName], keys...)
+}
+
+// wait waits until no Request of the cluster is reconciled, or until the deadline.
+// It returns the Requests still reconciled at the deadline.
+func (t *drainTracker) wait(clusterName string, deadline time.Time) []reconcile.Key {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		t.mu.Lock()
+		n, changed := len(t.inflight[clusterName]), t.changed
+		t.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return t.running(func(name string) bool { return name == clusterName })
+		}
+	}
+}
+
+// running returns the Requests being reconciled of the clusters matched by match.
+func (t *drainTracker) running(match func(clusterName string) bool) []reconcile.Key {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []reconcile.Key
+	for name, inflight := range t.inflight {
+		if !match(name) {
+			continue
+		}
+		for key := range inflight {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// gracePeriod returns how long the reconciles of a stopped cluster may keep running.
+func (c *Controller) gracePeriod() time.Duration {
+	if c.GracePeriod < 0 {
+		return 0
+	}
+	return c.GracePeriod
+}
+
+// DrainCluster detaches the given cluster, like DetachCluster, then waits for the reconciles of its Requests
+// to finish, for at most GracePeriod. The contexts of the reconciles still running at that point are cancelled.
+// It returns the abandoned Requests: those still running after the grace period, those held,
+// and those still queued, if the queue implements ClusterDropper.
+// The cluster's context should be done before calling DrainCluster.
+func (c *Controller) DrainCluster(cl cluster.ClusterCache) []reconcile.Key {
+	detached, abandoned := c.detach(cl)
+	if !detached {
+		return nil
+	}
+	name := cl.GetClusterName()
+	if d, ok := c.Queue.(ClusterDropper); ok {
+		for _, item := range d.DropCluster(name) {
+			if key, ok := item.(reconcile.Key); ok {
+				abandoned = append(abandoned, key)
+			}
+		}
+	}
+	abandoned = append(abandoned, c.drain.wait(name, time.Now().Add(c.gracePeriod()))...)
+	return append(abandoned, c.TakeAbandoned(name)...)
+}
+
+// TakeAbandoned returns the Requests of the cluster abandoned when the Controller stopped,
+// or when the cluster was detached, and forgets them.
+func (c *Controller) TakeAbandoned(clusterName string) []reconcile.Key {
+	c.drain.mu.Lock()
+	defer c.drain.mu.Unlock()
+	keys := c.drain.abandoned[clusterName]
+	delete(c.drain.abandoned, clusterName)
+	return keys
+}
+
+// drainContext returns a context with the values of parent, which is cancelled grace after parent is done.
+func drainContext(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	if grace <= 0 {
+		return context.WithCancel(parent)
+	}
+	ctx, cancel := context.WithCancel(valuesContext{parent})
+	go func() {
+		select {
+		case <-parent.Done():
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// valuesContext is a context with the values of its parent, which is never cancelled.
+type valuesContext struct {
+	parent context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valuesContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valuesContext) Err() error {
+	return nil
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,382 @@
+/*
+Copyright 2018 The Multicluster-Controller Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
+	"sync"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// FairQueueOptions is used as an argument of NewClusterFairQueue.
+type FairQueueOptions struct {
+	// Weights maps cluster names to their weight. A cluster of weight 2 gets twice as many turns
+	// as a cluster of weight 1 when both have queued Requests.
+	Weights map[string]int
+	// DefaultWeight is the weight of the clusters missing from Weights. Defaults to 1.
+	DefaultWeight int
+	// MaxConcurrency maps cluster names to the maximum number of their Requests processed at the same time.
+	MaxConcurrency map[string]int
+	// DefaultMaxConcurrency is the maximum concurrency of the clusters missing from MaxConcurrency.
+	// If unset (DefaultMaxConcurrency == 0), their concurrency is only bounded by the number of workers.
+	DefaultMaxConcurrency int
+	// RateLimiter is the rate limiter of the queue. Defaults to workqueue.DefaultControllerRateLimiter().
+	RateLimiter workqueue.RateLimiter
+	// Kind is the kind of the queued Requests, used to label the workqueue metrics.
+	Kind string
+}
+
+// ClusterFairQueue is a rate limiting queue that hands out Requests fairly across clusters.
+// Each cluster has its own FIFO, and the FIFOs are served in weighted round robin,
+// so a cluster relisting many objects cannot starve the others.
+// It is meant to be used as Options.Queue of a Controller shared by several clusters.
+type ClusterFairQueue struct {
+	workqueue.RateLimitingInterface
+	fair    *fairQueue
+	metrics *metrics.Queue
+}
+
+// NewClusterFairQueue creates a ClusterFairQueue.
+func NewClusterFairQueue(o FairQueueOptions) *ClusterFairQueue {
+	if o.DefaultWeight <= 0 {
+		o.DefaultWeight = 1
+	}
+	if o.RateLimiter == nil {
+		o.RateLimiter = workqueue.DefaultControllerRateLimiter()
+	}
+	fair := &fairQueue{
+		options:    o,
+		weights:    copyIntMap(o.Weights),
+		caps:       copyIntMap(o.MaxConcurrency),
+		overrides:  map[string][]*int{},
+		dirty:      map[interface{}]struct{}{},
+		processing: map[interface{}]string{},
+		queues:     map[string][]interface{}{},
+		active:     map[string]int{},
+	}
+	fair.cond = sync.NewCond(&fair.mu)
+	mq := metrics.NewQueue(fair, o.Kind)
+	di := workqueue.NewDelayingQueueWithCustomQueue(mq, "")
+	return &ClusterFairQueue{
+		RateLimitingInterface: workqueue.NewRateLimitingQueueWithDelayingInterface(di, o.RateLimiter),
+		fair:                  fair,
+		metrics:               mq,
+	}
+}
+
+// ClusterLen returns the number of Requests of the given cluster waiting to be processed.
+func (q *ClusterFairQueue) ClusterLen(cluster string) int {
+	q.fair.mu.Lock()
+	defer q.fair.mu.Unlock()
+	return len(q.fair.queues[cluster])
+}
+
+// DropCluster removes the Requests of the given cluster waiting to be processed, and returns them.
+// The Requests waiting for a delay to be added to the queue are not removed.
+func (q *ClusterFairQueue) DropCluster(cluster string) []interface{} {
+	q.fair.mu.Lock()
+	items := q.fair.drop(cluster)
+	q.fair.mu.Unlock()
+	for i := range items {
+		q.Forget(items[i])
+	}
+	q.metrics.Dropped(items...)
+	return items
+}
+
+// SetWeight sets the weight of a cluster. A weight <= 0 resets it to its weight in FairQueueOptions.Weights,
+// or to the default weight.
+func (q *ClusterFairQueue) SetWeight(cluster string, weight int) {
+	q.fair.mu.Lock()
+	defer q.fair.mu.Unlock()
+	if weight <= 0 {
+		weight = q.fair.options.Weights[cluster]
+	}
+	if weight <= 0 {
+		delete(q.fair.weights, cluster)
+		return
+	}
+	q.fair.weights[cluster] = weight
+}
+
+// SetMaxConcurrency sets the maximum concurrency of a cluster. A value <= 0 resets it to its value in
+// FairQueueOptions.MaxConcurrency, or to the default.
+func (q *ClusterFairQueue) SetMaxConcurrency(cluster string, n int) {
+	q.fair.mu.Lock()
+	defer q.fair.mu.Unlock()
+	if n <= 0 {
+		n = q.fair.options.MaxConcurrency[cluster]
+	}
+	if n <= 0 {
+		delete(q.fair.caps, cluster)
+	} else {
+		q.fair.caps[cluster] = n
+	}
+	q.fair.cond.Broadcast()
+}
+
+// OverrideMaxConcurrency overrides the maximum concurrency of a cluster with n, whatever its value set with
+// FairQueueOptions.MaxConcurrency or SetMaxConcurrency, until the returned func is called.
+// If the cluster is overridden several times, the latest override that is not removed yet applies.
+func (q *ClusterFairQueue) OverrideMaxConcurrency(cluster string, n int) (remove func()) {
+	override := &n
+	q.fair.mu.Lock()
+	q.fair.overrides[cluster] = append(q.fair.overrides[cluster], override)
+	q.fair.cond.Broadcast()
+	q.fair.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.fair.mu.Lock()
+			defer q.fair.mu.Unlock()
+			overrides := q.fair.overrides[cluster]
+			for i := range overrides {
+				if overrides[i] == override {
+					overrides = append(overrides[:i], overrides[i+1:]...)
+					break
+				}
+			}
+			if len(overrides) == 0 {
+				delete(q.fair.overrides, cluster)
+			} else {
+				q.fair.overrides[cluster] = overrides
+			}
+			q.fair.cond.Broadcast()
+		})
+	}
+}
+
+// fairQueue implements workqueue.Interface with one FIFO per cluster.
+// Like workqueue.Type, an item is never queued twice, nor processed concurrently:
+// an item added while it is processed is queued again when it is done.
+type fairQueue struct {
+	options FairQueueOptions
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	weights map[string]int
+	caps    map[string]int
+	// overrides maps clusters to their overridden maximum concurrency, latest last.
+	overrides map[string][]*int
+	// dirty holds the items to process, queued or being processed.
+	dirty map[interface{}]struct{}
+	// processing maps the items being processed to their cluster.
+	processing map[interface{}]string
+	// active maps clusters to their number of items being processed.
+	active map[string]int
+	// queues maps clusters to their FIFO, and order lists the clusters with a non empty FIFO.
+	queues map[string][]interface{}
+	order  []string
+	// cursor is the index in order of the cluster being served, which has credits turns left.
+	cursor  int
+	credits int
+	size    int
+
+	shuttingDown bool
+	drain        bool
+}
+
+func (q *fairQueue) Add(item interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if _, ok := q.dirty[item]; ok {
+		return
+	}
+	q.dirty[item] = struct{}{}
+	if _, ok := q.processing[item]; ok {
+		return
+	}
+	q.push(item)
+	q.cond.Signal()
+}
+
+func (q *fairQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+func (q *fairQueue) Get() (interface{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if item, ok := q.pop(); ok {
+			return item, false
+		}
+		if q.shuttingDown && q.size == 0 {
+			return nil, true
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *fairQueue) Done(item interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cluster, ok := q.processing[item]
+	if !ok {
+		return
+	}
+	delete(q.processing, item)
+	q.active[cluster]--
+	if q.active[cluster] <= 0 {
+		delete(q.active, cluster)
+	}
+	if _, ok := q.dirty[item]; ok {
+		q.push(item)
+	}
+	// a worker waiting for a cluster under its concurrency cap may proceed
+	q.cond.Broadcast()
+}
+
+func (q *fairQueue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.drain = false
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+func (q *fairQueue) ShutDownWithDrain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.drain = true
+	q.shuttingDown = true
+	q.cond.Broadcast()
+	for len(q.processing) > 0 && q.drain {
+		q.cond.Wait()
+	}
+}
+
+func (q *fairQueue) ShuttingDown() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.shuttingDown
+}
+
+// push appends item to the FIFO of its cluster. q.mu must be held.
+func (q *fairQueue) push(item interface{}) {
+	cluster := metrics.ClusterOf(item)
+	if len(q.queues[cluster]) == 0 {
+		q.order = append(q.order, cluster)
+	}
+	q.queues[cluster] = append(q.queues[cluster], item)
+	q.size++
+}
+
+// pop takes the next item in weighted round robin order, skipping the clusters at their concurrency cap.
+// q.mu must be held.
+func (q *fairQueue) pop() (interface{}, bool) {
+	n := len(q.order)
+	for i := 0; i < n; i++ {
+		idx := (q.cursor + i) % n
+		cluster := q.order[idx]
+		if limit := q.maxConcurrency(cluster); limit > 0 && q.active[cluster] >= limit {
+			continue
+		}
+		if idx != q.cursor || q.credits <= 0 {
+			q.cursor = idx
+			q.credits = q.weight(cluster)
+		}
+
+		fifo := q.queues[cluster]
+		item := fifo[0]
+		fifo[0] = nil
+		q.queues[cluster] = fifo[1:]
+		q.size--
+		q.credits--
+		if len(q.queues[cluster]) == 0 {
+			delete(q.queues, cluster)
+			q.order = append(q.order[:idx], q.order[idx+1:]...)
+			// the cursor now points to the next cluster
+			q.credits = 0
+			if q.cursor >= len(q.order) {
+				q.cursor = 0
+			}
+		} else if q.credits <= 0 {
+			q.cursor = (idx + 1) % len(q.order)
+		}
+
+		delete(q.dirty, item)
+		q.processing[item] = cluster
+		q.active[cluster]++
+		return item, true
+	}
+	return nil, false
+}
+
+// drop removes the items of cluster waiting to be processed, queued or added again while being processed.
+// q.mu must be held.
+func (q *fairQueue) drop(cluster string) []interface{} {
+	items := q.queues[cluster]
+	delete(q.queues, cluster)
+	for idx := range q.order {
+		if q.order[idx] != cluster {
+			continue
+		}
+		q.order = append(q.order[:idx], q.order[idx+1:]...)
+		if idx < q.cursor {
+			q.cursor--
+		} else if idx == q.cursor {
+			q.credits = 0
+		}
+		if q.cursor >= len(q.order) {
+			q.cursor = 0
+		}
+		break
+	}
+	q.size -= len(items)
+	for item, c := range q.processing {
+		if _, dirty := q.dirty[item]; dirty && c == cluster {
+			items = append(items, item)
+		}
+	}
+	for i := range items {
+		delete(q.dirty, items[i])
+	}
+	return items
+}
+
+func (q *fairQueue) weight(cluster string) int {
+	if w, ok := q.weights[cluster]; ok {
+		return w
+	}
+	return q.options.DefaultWeight
+}
+
+func (q *fairQueue) maxConcurrency(cluster string) int {
+	if overrides := q.overrides[cluster]; len(overrides) > 0 {
+		return *overrides[len(overrides)-1]
+	}
+	if c, ok := q.caps[cluster]; ok {
+		return c
+	}
+	return q.options.DefaultMaxConcurrency
+}
+
+func copyIntMap(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+)
+
+func (q *ClusterFairQueue) currentMaxConcurrency(cluster string) int {
+	q.fair.mu.Lock()
+	defer q.fair.mu.Unlock()
+	return q.fair.maxConcurrency(cluster)
+}
+
+// fill adds n Requests of each cluster to q.
+func fill(q *ClusterFairQueue, n int, clusters ...string) {
+	for _, cluster := range clusters {
+		for i := 0; i < n; i++ {
+			q.Add(testKey(cluster, fmt.Sprint(i)))
+		}
+	}
+}
+
+// clustersOfNext gets the next n Requests of q, marking each done before getting the next one,
+// and returns their clusters in order.
+func clustersOfNext(q *ClusterFairQueue, n int) []string {
+	clusters := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		item, _ := q.Get()
+		clusters = append(clusters, item.(reconcile.Key).ClusterName)
+		q.Done(item)
+	}
+	return clusters
+}
+
+func TestClusterFairQueueRoundRobin(t *testing.T) {
+	q := NewClusterFairQueue(FairQueueOptions{})
+	defer q.ShutDown()
+	// a noisy cluster relists many objects before a quiet one has any event
+	fill(q, 100, "noisy")
+	fill(q, 3, "quiet")
+
+	want := []string{"noisy", "quiet", "noisy", "quiet", "noisy", "quiet", "noisy", "noisy"}
+	if got := clustersOfNext(q, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters served %v, want %v", got, want)
+	}
+	if got := q.Len(); got != 100-5 {
+		t.Errorf("%d Requests left, want those of the noisy cluster", got)
+	}
+}
+
+func TestClusterFairQueueWeights(t *testing.T) {
+	q := NewClusterFairQueue(FairQueueOptions{Weights: map[string]int{"a": 2}})
+	defer q.ShutDown()
+	fill(q, 6, "a", "b")
+
+	want := []string{"a", "a", "b", "a", "a", "b", "a", "a", "b", "b", "b", "b"}
+	if got := clustersOfNext(q, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters served %v, want two turns of a for one of b", got)
+	}
+
+	q.SetWeight("a", 1)
+	fill(q, 3, "a", "b")
+	want = []string{"a", "b", "a", "b", "a", "b"}
+	if got := clustersOfNext(q, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters served %v after SetWeight, want one turn each", got)
+	}
+
+	// a weight reset goes back to the configured weight
+	q.SetWeight("a", 0)
+	fill(q, 3, "a", "b")
+	want = []string{"a", "a", "b", "a", "b", "b"}
+	if got := clustersOfNext(q, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters served %v after the weight reset, want two turns of a for one of b", got)
+	}
+}
+
+func TestClusterFairQueueDropCluster(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// served is the number of Requests got before dropping the cluster
+		served  int
+		drop    string
+		dropped int
+		want    []string
+	}{
+		{name: "cluster being served", served: 1, drop: "b", dropped: 3, want: []string{"c", "a", "c", "a"}},
+		{name: "cluster before the cursor", served: 2, drop: "a", dropped: 2, want: []string{"c", "b", "c", "b"}},
+		{name: "cluster after the cursor", served: 1, drop: "c", dropped: 3, want: []string{"b", "a", "b", "a"}},
+		{name: "last cluster with the cursor", served: 2, drop: "c", dropped: 3, want: []string{"a", "b", "a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewClusterFairQueue(FairQueueOptions{})
+			defer q.ShutDown()
+			fill(q, 3, "a", "b", "c")
+			clustersOfNext(q, tc.served)
+
+			if dropped := q.DropCluster(tc.drop); len(dropped) != tc.dropped {
+				t.Fatalf("dropped %v, want the %d queued Requests of the cluster", dropped, tc.dropped)
+			}
+			if got := clustersOfNext(q, len(tc.want)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("clusters served %v after dropping %s, want %v", got, tc.drop, tc.want)
+			}
+		})
+	}
+}
+
+func TestClusterFairQueueOverrideMaxConcurrency(t *testing.T) {
+	q := NewClusterFairQueue(FairQueueOptions{MaxConcurrency: map[string]int{"a": 1}, DefaultMaxConcurrency: 4})
+	defer q.ShutDown()
+	expect := func(step string, want int) {
+		t.Helper()
+		if got := q.currentMaxConcurrency("a"); got != want {
+			t.Fatalf("%s: max concurrency %d, want %d", step, got, want)
+		}
+	}
+
+	expect("configured", 1)
+	q.SetMaxConcurrency("a", 2)
+	expect("set", 2)
+	q.SetMaxConcurrency("a", 0)
+	expect("reset to the configured value", 1)
+
+	// a cluster restarted while its previous watch is stopping has two overrides for a while
+	removeOld := q.OverrideMaxConcurrency("a", 3)
+	expect("overridden", 3)
+	removeNew := q.OverrideMaxConcurrency("a", 5)
+	expect("overridden again", 5)
+	removeOld()
+	removeOld()
+	expect("previous override removed", 5)
+	removeNew()
+	expect("every override removed", 1)
+
+	if got := q.currentMaxConcurrency("b"); got != 4 {
+		t.Errorf("max concurrency of b %d, want the default", got)
+	}
+}
+
+func TestClusterFairQueueMaxConcurrency(t *testing.T) {
+	q := NewClusterFairQueue(FairQueueOptions{})
+	defer q.ShutDown()
+	remove := q.OverrideMaxConcurrency("a", 1)
+	q.Add(testKey("a", "x"))
+	q.Add(testKey("a", "y"))
+
+	first, _ := q.Get()
+	got := make(chan interface{})
+	go func() {
+		item, _ := q.Get()
+		got <- item
+	}()
+	select {
+	case item := <-got:
+		t.Fatalf("got %v while %v is processed, over the max concurrency", item, first)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	remove()
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second item must be processed once the override is removed")
+	}
+	q.Done(first)
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// histogramCount returns the number of observations of the series of the histogram with the given labels.
+func histogramCount(t *testing.T, name string, labels map[string]string) uint64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue series
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	const kind = "MetricsTest"
+	r := newRecordingReconciler()
+	r.reconcile = func(req reconcile.Request, calls int) (reconcile.Result, error) {
+		if calls > 1 {
+			return reconcile.Result{}, nil
+		}
+		switch req.Key.Name {
+		case "error":
+			return reconcile.Result{}, errors.New("failure")
+		case "terminal":
+			return reconcile.Result{}, reconcile.Terminal(errors.New("failure"))
+		case "requeue":
+			return reconcile.Result{Requeue: true}, nil
+		case "requeue-after":
+			return reconcile.Result{RequeueAfter: 10 * time.Millisecond}, nil
+		}
+		return reconcile.Result{}, nil
+	}
+	c := NewWithContext(r, Options{
+		Kind:        kind,
+		RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond),
+		GracePeriod: -1,
+	})
+	startController(t, c, &fakeCluster{name: "m"})
+
+	// the metrics are global: count from their current values
+	labels := map[string]string{"cluster": "m", "kind": kind}
+	counters := map[string]prometheus.Counter{
+		"retries": metrics.WorkqueueRetries.WithLabelValues("m", kind),
+		"adds":    metrics.WorkqueueAdds.WithLabelValues("m", kind),
+	}
+	for _, result := range []string{metrics.ResultSuccess, metrics.ResultError, metrics.ResultTerminalError,
+		metrics.ResultRequeue, metrics.ResultRequeueAfter} {
+		counters[result] = metrics.ReconcileTotal.WithLabelValues("m", kind, result)
+	}
+	before := map[string]float64{}
+	for name, counter := range counters {
+		before[name] = testutil.ToFloat64(counter)
+	}
+	durations := histogramCount(t, "mc_controller_reconcile_duration_seconds", labels)
+	latencies := histogramCount(t, "mc_workqueue_queue_duration_seconds", labels)
+
+	for _, name := range []string{"success", "error", "terminal", "requeue", "requeue-after"} {
+		c.Queue.Add(testKey("m", name))
+	}
+	// every Request but the terminal one is reconciled again, successfully
+	for i := 0; i < 8; i++ {
+		r.next(t)
+	}
+	r.none(t, 50*time.Millisecond)
+
+	for name, want := range map[string]float64{
+		metrics.ResultSuccess:       4,
+		metrics.ResultError:         1,
+		metrics.ResultTerminalError: 1,
+		metrics.ResultRequeue:       1,
+		metrics.ResultRequeueAfter:  1,
+		// the error and both requeues
+		"retries": 3,
+		// the first adds and the retries
+		"adds": 8,
+	} {
+		if got := testutil.ToFloat64(counters[name]) - before[name]; got != want {
+			t.Errorf("counted %v %s, want %v", got, name, want)
+		}
+	}
+	if depth := testutil.ToFloat64(metrics.WorkqueueDepth.WithLabelValues("m", kind)); depth != 0 {
+		t.Errorf("queue depth %v, want the queue empty", depth)
+	}
+	if n := histogramCount(t, "mc_controller_reconcile_duration_seconds", labels) - durations; n != 8 {
+		t.Errorf("observed %d reconcile durations, want 8", n)
+	}
+	if n := histogramCount(t, "mc_workqueue_queue_duration_seconds", labels) - latencies; n != 8 {
+		t.Errorf("observed %d queue latencies, want 8", n)
+	}
+}
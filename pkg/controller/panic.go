@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// PanicError is the error of a reconcile that panicked.
+type PanicError struct {
+	// Value is the value the reconciler panicked with.
+	Value interface{}
+	// Stack is the stack of the goroutine when it panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in reconciler: %v", e.Value)
+}
+
+// QuarantinePolicy decides when a cluster whose reconciler keeps panicking is quarantined.
+// The Requests of a quarantined cluster are not reconciled, but requeued until the quarantine ends.
+type QuarantinePolicy struct {
+	// MaxPanics is the number of panics within Window after which a cluster is quarantined. Defaults to 5.
+	MaxPanics int
+	// Window is the period the panics are counted over. Defaults to 1 minute.
+	Window time.Duration
+	// Duration is how long a cluster is quarantined. Defaults to 5 minutes.
+	Duration time.Duration
+}
+
+// panicTracker records the recent panics of each cluster and their quarantines.
+type panicTracker struct {
+	mu     sync.Mutex
+	panics map[string][]time.Time
+	until  map[string]time.Time
+}
+
+// recoverPanic reports whether the panics of the reconciler are recovered.
+func (c *Controller) recoverPanic() bool {
+	return c.RecoverPanic == nil || *c.RecoverPanic
+}
+
+// reconcile runs the reconciler, turning its panic into a *PanicError if panics are recovered.
+func (c *Controller) reconcile(ctx context.Context, req reconcile.Request) (result reconcile.Result, err error) {
+	if c.recoverPanic() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return c.reconciler.Reconcile(ctx, req)
+}
+
+// recordPanic records a panic of the reconciler for a Request of the cluster,
+// and quarantines the cluster according to the QuarantinePolicy.
+// It returns the end of the quarantine if the cluster was just quarantined.
+func (c *Controller) recordPanic(clusterName string) (time.Time, bool) {
+	p := c.QuarantinePolicy
+	if p == nil {
+		return time.Time{}, false
+	}
+	c.panics.mu.Lock()
+	defer c.panics.mu.Unlock()
+	now := time.Now()
+	recent := c.panics.panics[clusterName][:0]
+	for _, t := range c.panics.panics[clusterName] {
+		if now.Sub(t) < p.Window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < p.MaxPanics {
+		c.panics.panics[clusterName] = recent
+		return time.Time{}, false
+	}
+	delete(c.panics.panics, clusterName)
+	until := now.Add(p.Duration)
+	c.panics.until[clusterName] = until
+	return until, true
+}
+
+// Quarantined returns the end of the quarantine of a cluster, if it is quarantined.
+func (c *Controller) Quarantined(clusterName string) (time.Time, bool) {
+	c.panics.mu.Lock()
+	defer c.panics.mu.Unlock()
+	until, ok := c.panics.until[clusterName]
+	if ok && !time.Now().Before(until) {
+		delete(c.panics.until, clusterName)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// ReleaseCluster ends the quarantine of a cluster, and forgets its recent panics.
+func (c *Controller) ReleaseCluster(clusterName string) {
+	c.panics.mu.Lock()
+	defer c.panics.mu.Unlock()
+	delete(c.panics.until, clusterName)
+	delete(c.panics.panics, clusterName)
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestQuarantinePolicy(t *testing.T) {
+	r := newRecordingReconciler()
+	r.reconcile = func(req reconcile.Request, calls int) (reconcile.Result, error) {
+		if req.Key.Name == "x" && calls <= 3 {
+			panic("reconciler panics")
+		}
+		return reconcile.Result{}, nil
+	}
+	c := NewWithContext(r, Options{
+		Kind:             "QuarantineTest",
+		RateLimiter:      workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond),
+		QuarantinePolicy: &QuarantinePolicy{MaxPanics: 3, Window: time.Minute, Duration: 300 * time.Millisecond},
+		GracePeriod:      -1,
+	})
+	startController(t, c, &fakeCluster{name: "a"}, &fakeCluster{name: "b"})
+	panics := metrics.ReconcilePanics.WithLabelValues("a", "QuarantineTest")
+	before := testutil.ToFloat64(panics)
+
+	c.Queue.Add(testKey("a", "x"))
+	for i := 0; i < 3; i++ {
+		if req := r.next(t); req.Key != testKey("a", "x") {
+			t.Fatalf("reconciled %v, want the panicking Request retried", req.Key)
+		}
+	}
+	until, quarantined := c.Quarantined("a")
+	if !quarantined {
+		t.Fatal("a cluster whose reconciler keeps panicking must be quarantined")
+	}
+	if got := testutil.ToFloat64(panics) - before; got != 3 {
+		t.Errorf("counted %v panics, want 3", got)
+	}
+
+	// the Requests of the quarantined cluster wait, the other clusters go on
+	c.Queue.Add(testKey("a", "y"))
+	c.Queue.Add(testKey("b", "y"))
+	if req := r.next(t); req.Key != testKey("b", "y") {
+		t.Fatalf("reconciled %v during the quarantine", req.Key)
+	}
+	r.none(t, time.Until(until)-50*time.Millisecond)
+
+	// the quarantine ends after its duration
+	got := map[reconcile.Key]bool{}
+	for i := 0; i < 2; i++ {
+		got[r.next(t).Key] = true
+	}
+	if !got[testKey("a", "x")] || !got[testKey("a", "y")] {
+		t.Errorf("reconciled %v after the quarantine, want the requeued Requests", got)
+	}
+	if time.Now().Before(until) {
+		t.Error("reconciled before the end of the quarantine")
+	}
+	if _, quarantined := c.Quarantined("a"); quarantined {
+		t.Error("the quarantine must end after its duration")
+	}
+}
+
+func TestReleaseCluster(t *testing.T) {
+	c := NewWithContext(newRecordingReconciler(), Options{QuarantinePolicy: &QuarantinePolicy{MaxPanics: 2}})
+	if _, quarantined := c.recordPanic("a"); quarantined {
+		t.Fatal("quarantined before MaxPanics")
+	}
+	if _, quarantined := c.recordPanic("a"); !quarantined {
+		t.Fatal("not quarantined after MaxPanics")
+	}
+	if until, ok := c.Quarantined("a"); !ok || time.Until(until) < 4*time.Minute {
+		t.Fatalf("quarantined until %v, want the default duration", until)
+	}
+	c.ReleaseCluster("a")
+	if _, ok := c.Quarantined("a"); ok {
+		t.Error("a released cluster is not quarantined")
+	}
+	// the panics before the release are forgotten
+	if _, quarantined := c.recordPanic("a"); quarantined {
+		t.Error("quarantined again by a single panic after the release")
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	r := newRecordingReconciler()
+	r.reconcile = func(reconcile.Request, int) (reconcile.Result, error) {
+		panic("reconciler panics")
+	}
+	newController := func(recoverPanic bool) (*Controller, context.Context) {
+		c := NewWithContext(r, Options{RecoverPanic: &recoverPanic})
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		if err := c.WatchResourceReconcileObject(ctx, &fakeCluster{name: "a"}, &corev1.Pod{}, WatchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		c.Queue.Add(testKey("a", "x"))
+		return c, ctx
+	}
+
+	c, ctx := newController(true)
+	c.processNextWorkItem(ctx)
+	r.next(t)
+	var panicErr *PanicError
+	if _, err := c.reconcile(ctx, reconcile.Request{Key: testKey("a", "x")}); !errors.As(err, &panicErr) ||
+		panicErr.Value != "reconciler panics" || len(panicErr.Stack) == 0 {
+		t.Errorf("recovered error = %v, want a PanicError with its stack", err)
+	}
+	r.next(t)
+
+	c, ctx = newController(false)
+	func() {
+		defer func() {
+			if v := recover(); v != "reconciler panics" {
+				t.Errorf("recovered %v, want the panic of the reconciler to propagate", v)
+			}
+		}()
+		c.processNextWorkItem(ctx)
+		t.Error("processNextWorkItem returned, want the panic of the reconciler to propagate")
+	}()
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Multicluster-Controller Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"github.com/wangguoyan/mc-operator/pkg/cluster"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// MapFunc maps an object of the given cluster to the Keys of the objects to reconcile in the same cluster.
+// The Keys are always enqueued for the cluster of the object: their ClusterName is overwritten.
+type MapFunc func(cluster cluster.ClusterCache, obj client.Object) []reconcile.Key
+
+// EnqueueRequestsFromMapFunc enqueues the Keys returned by ToRequests for the objects of the events,
+// e.g. to reconcile the objects referencing a ConfigMap or a Secret when it changes.
+// On update, the Keys of both the old and the new object are enqueued.
+type EnqueueRequestsFromMapFunc struct {
+	Cluster    cluster.ClusterCache
+	Queue      workqueue.Interface
+	Filter     func(obj interface{}) bool
+	Predicates []predicate.Predicate
+	ToRequests MapFunc
+}
+
+func (e *EnqueueRequestsFromMapFunc) enqueue(objs ...client.Object) {
+	seen := map[reconcile.Key]struct{}{}
+	for _, obj := range objs {
+		for _, r := range e.ToRequests(e.Cluster, obj) {
+			// the queue of a cluster only reconciles the Requests of its own cluster
+			r.ClusterName = e.Cluster.GetClusterName()
+			if _, ok := seen[r]; ok {
+				continue
+			}
+			seen[r] = struct{}{}
+			e.Queue.Add(r)
+		}
+	}
+}
+
+func (e *EnqueueRequestsFromMapFunc) OnAdd(obj interface{}) {
+	if !e.Filter(obj) {
+		return
+	}
+	c := event.CreateEvent{}
+
+	// Pull Object out of the object
+	if o, ok := obj.(client.Object); ok {
+		c.Object = o
+	} else {
+		return
+	}
+	for _, p := range e.Predicates {
+		if !p.Create(c) {
+			return
+		}
+	}
+	e.enqueue(c.Object)
+}
+
+func (e *EnqueueRequestsFromMapFunc) OnUpdate(oldObj, newObj interface{}) {
+	if !e.Filter(newObj) {
+		return
+	}
+	u := event.UpdateEvent{}
+
+	if o, ok := oldObj.(client.Object); ok {
+		u.ObjectOld = o
+	} else {
+		return
+	}
+
+	// Pull Object out of the object
+	if o, ok := newObj.(client.Object); ok {
+		u.ObjectNew = o
+	} else {
+		return
+	}
+
+	for _, p := range e.Predicates {
+		if !p.Update(u) {
+			return
+		}
+	}
+
+	e.enqueue(u.ObjectOld, u.ObjectNew)
+}
+
+func (e *EnqueueRequestsFromMapFunc) OnDelete(obj interface{}) {
+	// If the object doesn't have Metadata, assume it is a tombstone object of type DeletedFinalStateUnknown
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if !e.Filter(obj) {
+		return
+	}
+	d := event.DeleteEvent{}
+
+	// Pull Object out of the object
+	if o, ok := obj.(client.Object); ok {
+		d.Object = o
+	} else {
+		return
+	}
+	for _, p := range e.Predicates {
+		if !p.Delete(d) {
+			return
+		}
+	}
+	e.enqueue(d.Object)
+}
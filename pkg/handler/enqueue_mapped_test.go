@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wangguoyan/mc-operator/pkg/cluster"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fakeCluster is a cluster whose events are sent to the handlers by the tests.
+type fakeCluster struct {
+	name string
+}
+
+func (c *fakeCluster) GetClusterName() string {
+	return c.name
+}
+
+func (c *fakeCluster) AddEventHandler(context.Context, client.Object, cache.ResourceEventHandler) error {
+	return nil
+}
+
+func (c *fakeCluster) GetDelegatingClient() (*client.Client, error) {
+	return nil, nil
+}
+
+func (c *fakeCluster) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (c *fakeCluster) WaitForCacheSync(context.Context) bool {
+	return true
+}
+
+func TestEnqueueRequestsFromMapFunc(t *testing.T) {
+	queue := workqueue.New()
+	defer queue.ShutDown()
+	h := &EnqueueRequestsFromMapFunc{
+		Cluster: &fakeCluster{name: "a"},
+		Queue:   queue,
+		Filter:  func(interface{}) bool { return true },
+		ToRequests: func(_ cluster.ClusterCache, obj client.Object) []reconcile.Key {
+			name := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetLabels()["app"]}
+			return []reconcile.Key{{NamespacedName: name}, {ClusterName: "b", NamespacedName: name}}
+		},
+	}
+	configMap := func(app string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config", Labels: map[string]string{"app": app}}}
+	}
+
+	h.OnUpdate(configMap("x"), configMap("y"))
+	want := []reconcile.Key{
+		{ClusterName: "a", NamespacedName: types.NamespacedName{Namespace: "default", Name: "x"}},
+		{ClusterName: "a", NamespacedName: types.NamespacedName{Namespace: "default", Name: "y"}},
+	}
+	if queue.Len() != len(want) {
+		t.Fatalf("enqueued %d keys, want the keys of both objects in the cluster of the event", queue.Len())
+	}
+	for i := range want {
+		item, _ := queue.Get()
+		if item != want[i] {
+			t.Errorf("enqueued %v, want %v", item, want[i])
+		}
+		queue.Done(item)
+	}
+}
@@ -40,7 +40,7 @@ func (e *EnqueueRequestForObject) enqueue(obj interface{}) {
 	if err != nil {
 		return
 	}
-	r := reconcile.Request{Cluster: e.Cluster}
+	r := reconcile.Key{ClusterName: e.Cluster.GetClusterName()}
 	r.Namespace = o.GetNamespace()
 	r.Name = o.GetName()
 
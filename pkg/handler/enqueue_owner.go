@@ -42,7 +42,7 @@ func (e *EnqueueRequestForOwner) enqueue(obj interface{}) {
 	if err != nil {
 		return
 	}
-	r := reconcile.Request{Cluster: e.Cluster}
+	r := reconcile.Key{ClusterName: e.Cluster.GetClusterName()}
 	var ref *v1.OwnerReference
 	ownerReferences := o.GetOwnerReferences()
 	for i := range ownerReferences {
@@ -1,6 +1,10 @@
 package job
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
+
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -11,7 +15,10 @@ func CreateClusterClientset(cfg *rest.Config) *kubernetes.Clientset {
 }
 
 func CreateClusterRESTClient(cluster ClusterInfoInterface) (*rest.RESTClient, error) {
-	cfg := GetCfgByClusterInfo(cluster)
+	cfg, err := GetCfgByClusterInfo(cluster)
+	if err != nil {
+		return nil, err
+	}
 	setConfigDefaults(cfg)
 	return rest.RESTClientFor(cfg)
 }
@@ -23,18 +30,59 @@ func setConfigDefaults(config *rest.Config) {
 	}
 }
 
-func GetCfgByClusterInfo(info ClusterInfoInterface) *rest.Config {
+// GetCfgByClusterInfo returns the rest.Config used to reach the cluster.
+// If the cluster has no RestConfig, one is built from its apiserver, credentials and TLS settings.
+// The apiserver certificate is always verified, unless the cluster explicitly opted in to insecure mode.
+// A credential source or exec plugin of the cluster takes precedence over static credentials.
+func GetCfgByClusterInfo(info ClusterInfoInterface) (*rest.Config, error) {
+	cfg, err := getBaseCfgByClusterInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	if exec := info.GetExecProvider(); exec != nil {
+		cfg.BearerToken = ""
+		cfg.BearerTokenFile = ""
+		cfg.ExecProvider = exec.DeepCopy()
+	}
+	if src := info.GetCredentialSource(); src != nil {
+		setCredentialSource(cfg, src)
+	}
+	return cfg, nil
+}
+
+func getBaseCfgByClusterInfo(info ClusterInfoInterface) (*rest.Config, error) {
 	if info.RestConfig() != nil {
-		return info.RestConfig()
+		return rest.CopyConfig(info.RestConfig()), nil
+	}
+	if info.GetApiServer() == "" {
+		return nil, fmt.Errorf("cluster %s has no apiserver", info.GetClusterName())
+	}
+	if info.IsInsecure() && len(info.GetCAData()) > 0 {
+		return nil, fmt.Errorf("cluster %s: a CA bundle cannot be used in insecure mode", info.GetClusterName())
 	}
-	tlsClientConfig := rest.TLSClientConfig{
-		Insecure: true,
+	if (len(info.GetCertData()) == 0) != (len(info.GetKeyData()) == 0) {
+		return nil, fmt.Errorf("cluster %s: client certificate and key must be set together", info.GetClusterName())
 	}
+
 	cfg := rest.Config{
-		Host:            info.GetApiServer(),
-		TLSClientConfig: tlsClientConfig,
-		BearerToken:     info.GetToken(),
+		Host: info.GetApiServer(),
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure:   info.IsInsecure(),
+			ServerName: info.GetTLSServerName(),
+			CAData:     info.GetCAData(),
+			CertData:   info.GetCertData(),
+			KeyData:    info.GetKeyData(),
+		},
+		BearerToken: info.GetToken(),
+		Impersonate: info.GetImpersonate(),
+	}
+	if info.GetProxyURL() != "" {
+		u, err := url.Parse(info.GetProxyURL())
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s has an invalid proxy url: %w", info.GetClusterName(), err)
+		}
+		cfg.Proxy = http.ProxyURL(u)
 	}
 
-	return &cfg
+	return &cfg, nil
 }
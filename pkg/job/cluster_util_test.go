@@ -0,0 +1,176 @@
+package job
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// newTestAPIServer starts a TLS server answering /version to the requests bearing token, if set.
+// If clientCAs is set, the clients must present a certificate signed by it.
+func newTestAPIServer(t *testing.T, token string, clientCAs *x509.CertPool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Impersonated", r.Header.Get("Impersonate-User"))
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		_, _ = w.Write([]byte(`{"major":"1","minor":"25"}`))
+	}))
+	// the rejected handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	if clientCAs != nil {
+		srv.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serverCAData returns the PEM encoded certificate of srv, to verify it with.
+func serverCAData(srv *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+}
+
+// newClientCertificate returns a self signed client certificate for commonName, its key, and a pool to verify it with.
+func newClientCertificate(t *testing.T, commonName string) ([]byte, []byte, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), pool
+}
+
+// getVersion gets /version of the cluster with the config built for info.
+func getVersion(t *testing.T, info ClusterInfoInterface) (*http.Response, error) {
+	t.Helper()
+	cfg, err := GetCfgByClusterInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := rest.HTTPClientFor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(cfg.Host + "/version")
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return resp, nil
+}
+
+func TestGetCfgByClusterInfoVerifiesCA(t *testing.T) {
+	srv := newTestAPIServer(t, "token", nil)
+
+	resp, err := getVersion(t, NewClusterWithToken("a", srv.URL, "token", WithCAData(serverCAData(srv))))
+	if err != nil {
+		t.Fatalf("the apiserver must be trusted with its CA: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want the token to be sent", resp.StatusCode)
+	}
+
+	if _, err := getVersion(t, NewClusterWithToken("a", srv.URL, "token")); err == nil {
+		t.Error("the apiserver must not be trusted without its CA")
+	}
+
+	_, err = getVersion(t, NewClusterWithToken("a", srv.URL, "token",
+		WithCAData(serverCAData(srv)), WithTLSServerName("other.test")))
+	if err == nil {
+		t.Error("the apiserver certificate must be verified against the TLS server name")
+	}
+	_, err = getVersion(t, NewClusterWithToken("a", srv.URL, "token",
+		WithCAData(serverCAData(srv)), WithTLSServerName("example.com")))
+	if err != nil {
+		t.Errorf("the apiserver certificate is valid for example.com: %v", err)
+	}
+}
+
+func TestGetCfgByClusterInfoClientCertificate(t *testing.T) {
+	certData, keyData, pool := newClientCertificate(t, "operator")
+	srv := newTestAPIServer(t, "", pool)
+
+	resp, err := getVersion(t, NewClusterWithToken("a", srv.URL, "",
+		WithCAData(serverCAData(srv)), WithClientCertificate(certData, keyData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Client"); got != "operator" {
+		t.Errorf("client = %q, want operator", got)
+	}
+
+	if _, err := getVersion(t, NewClusterWithToken("a", srv.URL, "", WithCAData(serverCAData(srv)))); err == nil {
+		t.Error("the apiserver requires a client certificate")
+	}
+}
+
+func TestGetCfgByClusterInfoInsecure(t *testing.T) {
+	srv := newTestAPIServer(t, "token", nil)
+
+	resp, err := getVersion(t, NewClusterWithToken("a", srv.URL, "token",
+		WithInsecure(), WithImpersonate(rest.ImpersonationConfig{UserName: "alice"})))
+	if err != nil {
+		t.Fatalf("an insecure cluster must not verify the apiserver: %v", err)
+	}
+	if got := resp.Header.Get("Impersonated"); got != "alice" {
+		t.Errorf("impersonated user = %q, want alice", got)
+	}
+}
+
+func TestGetCfgByClusterInfoRejectsInvalidTLS(t *testing.T) {
+	certData, keyData, _ := newClientCertificate(t, "operator")
+	for name, info := range map[string]ClusterInfoInterface{
+		"CA in insecure mode": NewClusterWithToken("a", "https://a.example.com", "", WithCAData([]byte("ca")), WithInsecure()),
+		"certificate only":    NewClusterWithToken("a", "https://a.example.com", "", WithClientCertificate(certData, nil)),
+		"key only":            NewClusterWithToken("a", "https://a.example.com", "", WithClientCertificate(nil, keyData)),
+		"no apiserver":        NewClusterWithToken("a", "", "token"),
+	} {
+		if _, err := GetCfgByClusterInfo(info); err == nil {
+			t.Errorf("%s: the config must be rejected", name)
+		}
+	}
+}
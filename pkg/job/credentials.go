@@ -0,0 +1,81 @@
+package job
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+// defaultTokenLifetime is how long a token without expiry is reused before the CredentialSource is asked again.
+const defaultTokenLifetime = time.Minute
+
+// CredentialSource supplies the bearer token of a cluster, which can change during the lifetime of its watch.
+// Token is called when the cached token expires or is rejected by the apiserver,
+// so the client, cache and mapper of the cluster pick up a new token without being recreated.
+type CredentialSource interface {
+	// Token returns the current token and its expiry.
+	// A token with a zero expiry is reused for a minute, unless it is rejected before.
+	Token() (token string, expiry time.Time, err error)
+}
+
+// CredentialFunc is a CredentialSource implemented by a callback.
+type CredentialFunc func() (token string, expiry time.Time, err error)
+
+// Token implements CredentialSource.
+func (f CredentialFunc) Token() (string, time.Time, error) {
+	return f()
+}
+
+// TokenFileSource is a CredentialSource reading the token from a file,
+// e.g. a projected service account token. The file is read again every minute.
+type TokenFileSource struct {
+	Path string
+}
+
+// NewTokenFileSource creates a TokenFileSource reading path.
+func NewTokenFileSource(path string) *TokenFileSource {
+	return &TokenFileSource{Path: path}
+}
+
+// Token implements CredentialSource.
+func (s *TokenFileSource) Token() (string, time.Time, error) {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("token file %s is empty", s.Path)
+	}
+	return token, time.Now().Add(defaultTokenLifetime), nil
+}
+
+// oauth2TokenSource adapts a CredentialSource to an oauth2.TokenSource.
+type oauth2TokenSource struct {
+	src CredentialSource
+}
+
+func (s oauth2TokenSource) Token() (*oauth2.Token, error) {
+	token, expiry, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if expiry.IsZero() {
+		expiry = time.Now().Add(defaultTokenLifetime)
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// setCredentialSource makes cfg authenticate with the tokens of src.
+// The token is cached until it expires, and dropped as soon as the apiserver answers 401 Unauthorized.
+func setCredentialSource(cfg *rest.Config, src CredentialSource) {
+	cfg.BearerToken = ""
+	cfg.BearerTokenFile = ""
+	ts := transport.NewCachedTokenSource(oauth2TokenSource{src: src})
+	cfg.Wrap(transport.ResettableTokenSourceWrapTransport(ts))
+}
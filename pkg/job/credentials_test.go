@@ -0,0 +1,124 @@
+package job
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// rotatingAPIServer is a fake apiserver only accepting its current token.
+type rotatingAPIServer struct {
+	*httptest.Server
+	token    atomic.Value
+	rejected int32
+}
+
+func newRotatingAPIServer(t *testing.T, token string) *rotatingAPIServer {
+	t.Helper()
+	s := &rotatingAPIServer{}
+	s.token.Store(token)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+s.token.Load().(string) {
+			atomic.AddInt32(&s.rejected, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major":"1","minor":"25","gitVersion":"v1.25.2"}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newRotatingClient creates a clientset of the cluster of info, once for the whole test.
+func newRotatingClient(t *testing.T, info ClusterInfoInterface) *kubernetes.Clientset {
+	t.Helper()
+	cfg, err := GetCfgByClusterInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestCredentialSourceRotation(t *testing.T) {
+	srv := newRotatingAPIServer(t, "old")
+	var mu sync.Mutex
+	token, calls := "old", 0
+	src := CredentialFunc(func() (string, time.Time, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// no expiry: the token is only fetched again once rejected
+		return token, time.Time{}, nil
+	})
+	client := newRotatingClient(t, NewClusterWithToken("a", srv.URL, "static",
+		WithCAData(serverCAData(srv.Server)), WithCredentialSource(src)))
+
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		t.Fatalf("the current token must be accepted: %v", err)
+	}
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if calls != 1 {
+		t.Errorf("the token was fetched %d times, want it cached", calls)
+	}
+	mu.Unlock()
+
+	// the apiserver rotates the token: the old one is rejected once, then the new one is fetched
+	mu.Lock()
+	token = "new"
+	mu.Unlock()
+	srv.token.Store("new")
+	if _, err := client.Discovery().ServerVersion(); err == nil {
+		t.Fatal("the old token must be rejected")
+	}
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		t.Fatalf("the new token must be used by the same client: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if rejected := atomic.LoadInt32(&srv.rejected); calls != 2 || rejected != 1 {
+		t.Errorf("the token was fetched %d times and rejected %d times, want 2 and 1", calls, rejected)
+	}
+}
+
+func TestTokenFileSourceRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newRotatingAPIServer(t, "old")
+	client := newRotatingClient(t, NewClusterWithToken("a", srv.URL, "",
+		WithCAData(serverCAData(srv.Server)), WithCredentialSource(NewTokenFileSource(path))))
+
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		t.Fatalf("the token of the file must be accepted: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv.token.Store("new")
+	// the cached token is rejected and dropped, the next request reads the file again
+	_, _ = client.Discovery().ServerVersion()
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		t.Fatalf("the rotated token of the file must be used: %v", err)
+	}
+
+	if _, _, err := NewTokenFileSource(filepath.Join(t.TempDir(), "missing")).Token(); err == nil {
+		t.Error("a missing token file must be reported")
+	}
+}
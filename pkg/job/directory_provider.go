@@ -0,0 +1,246 @@
+package job
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+)
+
+// directoryRescanDelay groups the bursts of file system events caused by a single write.
+const directoryRescanDelay = 200 * time.Millisecond
+
+// DirectoryClusterProvider is a ClusterProvider backed by a directory holding one kubeconfig file per cluster.
+// Each cluster is named after its file, without the extension, and uses the kubeconfig's current context.
+// Adding a file adds the cluster, editing it updates the cluster and removing it removes the cluster.
+// Hidden files are ignored, so the directory can be a mounted Secret or ConfigMap.
+// The certificate authority, client certificate and key files a kubeconfig refers to are inlined in the
+// cluster, and their directories are watched too, so that rotating them updates the cluster.
+// A token file is not inlined: the clients read it again by themselves.
+type DirectoryClusterProvider struct {
+	Dir string
+}
+
+// NewDirectoryClusterProvider creates a DirectoryClusterProvider watching dir.
+func NewDirectoryClusterProvider(dir string) *DirectoryClusterProvider {
+	return &DirectoryClusterProvider{Dir: dir}
+}
+
+// kubeconfigFile is a kubeconfig file already reported by a DirectoryClusterProvider.
+type kubeconfigFile struct {
+	// sum is the checksum of the kubeconfig with its referenced files inlined.
+	sum     [sha256.Size]byte
+	cluster ClusterInfoInterface
+	// refs are the files the kubeconfig refers to.
+	refs []string
+}
+
+// Run implements ClusterProvider.
+func (p *DirectoryClusterProvider) Run(ctx context.Context, events chan<- ClusterEvent) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(p.Dir); err != nil {
+		return err
+	}
+
+	known := map[string]kubeconfigFile{}
+	if err := p.rescan(ctx, events, known); err != nil {
+		return err
+	}
+	watched := map[string]bool{p.Dir: true}
+	p.watchReferencedDirs(ctx, watcher, known, watched)
+
+	rescan := time.NewTimer(directoryRescanDelay)
+	rescan.Stop()
+	defer rescan.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			rescan.Reset(directoryRescanDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			klog.FromContext(ctx).Error(err, "Watch kubeconfig directory failed", "dir", p.Dir)
+		case <-rescan.C:
+			if err := p.rescan(ctx, events, known); err != nil {
+				klog.FromContext(ctx).Error(err, "Scan kubeconfig directory failed", "dir", p.Dir)
+			}
+			p.watchReferencedDirs(ctx, watcher, known, watched)
+		}
+	}
+}
+
+// watchReferencedDirs watches the directories of the files referenced by the known kubeconfigs,
+// and stops watching those no longer referenced. watched holds the directories watched so far.
+func (p *DirectoryClusterProvider) watchReferencedDirs(ctx context.Context, watcher *fsnotify.Watcher, known map[string]kubeconfigFile, watched map[string]bool) {
+	dirs := map[string]bool{p.Dir: true}
+	for _, f := range known {
+		for _, ref := range f.refs {
+			dirs[filepath.Dir(ref)] = true
+		}
+	}
+	for dir := range dirs {
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			klog.FromContext(ctx).Error(err, "Watch directory of kubeconfig references failed", "dir", dir)
+			continue
+		}
+		watched[dir] = true
+	}
+	for dir := range watched {
+		if !dirs[dir] {
+			_ = watcher.Remove(dir)
+			delete(watched, dir)
+		}
+	}
+}
+
+// rescan compares the directory with the files reported so far,
+// and reports the clusters whose file was added, changed or removed.
+// A file whose cluster name is already taken by another file, e.g. a.yaml and a.yml, is rejected
+// until the other file is removed.
+func (p *DirectoryClusterProvider) rescan(ctx context.Context, events chan<- ClusterEvent, known map[string]kubeconfigFile) error {
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(p.Dir, entry.Name())
+		// follow symlinks, as used by mounted Secrets and ConfigMaps
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			continue
+		}
+		paths = append(paths, path)
+		seen[path] = true
+	}
+
+	// remove first, so the cluster name of a removed file can be taken by another file
+	owners := map[string]string{}
+	for path, f := range known {
+		if seen[path] {
+			owners[f.cluster.GetClusterName()] = path
+			continue
+		}
+		delete(known, path)
+		if !sendClusterEvent(ctx, events, ClusterEvent{Type: ClusterRemoved, Cluster: f.cluster}) {
+			return nil
+		}
+	}
+
+	for _, path := range paths {
+		name := clusterNameOfFile(path)
+		if owner, ok := owners[name]; ok && owner != path {
+			klog.FromContext(ctx).Error(nil, "Ignore kubeconfig, its cluster name is taken by another file", "path", path, "cluster", name, "other", owner)
+			continue
+		}
+		raw, refs, err := loadKubeconfigFile(path)
+		if err != nil {
+			// keep the previous version of the file, if any, until it is fixed
+			klog.FromContext(ctx).Error(err, "Load kubeconfig failed", "path", path)
+			continue
+		}
+		content, err := clientcmd.Write(*raw)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "Load kubeconfig failed", "path", path)
+			continue
+		}
+
+		sum := sha256.Sum256(content)
+		old, ok := known[path]
+		if ok && old.sum == sum {
+			continue
+		}
+		info, err := clusterFromKubeconfig(path, raw)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "Load kubeconfig failed", "path", path)
+			continue
+		}
+		known[path] = kubeconfigFile{sum: sum, cluster: info, refs: refs}
+		owners[name] = path
+
+		t := ClusterAdded
+		if ok {
+			t = ClusterUpdated
+		}
+		if !sendClusterEvent(ctx, events, ClusterEvent{Type: t, Cluster: info}) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// clusterNameOfFile returns the name of the cluster of a kubeconfig file: the file name without its extension.
+func clusterNameOfFile(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// clusterFromKubeconfigFile builds a cluster named after the file from the kubeconfig's current context.
+// The relative paths of the kubeconfig, e.g. of certificate-authority, are resolved against the directory of the file.
+func clusterFromKubeconfigFile(path string) (ClusterInfoInterface, error) {
+	raw, _, err := loadKubeconfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return clusterFromKubeconfig(path, raw)
+}
+
+// loadKubeconfigFile loads a kubeconfig file with the certificate authority, client certificate and key files
+// it refers to inlined, and returns the paths of these files.
+func loadKubeconfigFile(path string) (*clientcmdapi.Config, []string, error) {
+	raw, err := (&clientcmd.ClientConfigLoadingRules{ExplicitPath: path}).Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the paths are absolute once loaded
+	var refs []string
+	for _, c := range raw.Clusters {
+		if c.CertificateAuthority != "" {
+			refs = append(refs, c.CertificateAuthority)
+		}
+	}
+	for _, a := range raw.AuthInfos {
+		for _, ref := range []string{a.ClientCertificate, a.ClientKey} {
+			if ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	if err := clientcmdapi.FlattenConfig(raw); err != nil {
+		return nil, nil, err
+	}
+	return raw, refs, nil
+}
+
+// clusterFromKubeconfig builds a cluster named after the kubeconfig file from the current context of raw.
+func clusterFromKubeconfig(path string, raw *clientcmdapi.Config) (ClusterInfoInterface, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: path}
+	cfg, err := clientcmd.NewNonInteractiveClientConfig(*raw, raw.CurrentContext, &clientcmd.ConfigOverrides{}, rules).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewClusterWithCfg(clusterNameOfFile(path), cfg), nil
+}
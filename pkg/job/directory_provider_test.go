@@ -0,0 +1,194 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: c
+  cluster:
+    server: https://%s.example.com
+    certificate-authority: certs/ca.crt
+users:
+- name: u
+  user:
+    token: token
+contexts:
+- name: ctx
+  context:
+    cluster: c
+    user: u
+current-context: ctx
+`
+
+// writeKubeconfig writes a kubeconfig for server, and the CA it refers to with a path relative to the kubeconfig.
+func writeKubeconfig(t *testing.T, path, server string) {
+	t.Helper()
+	certs := filepath.Join(filepath.Dir(path), "certs")
+	if err := os.MkdirAll(certs, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(certs, "ca.crt"), []byte("ca"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(fmt.Sprintf(testKubeconfig, server))
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterFromKubeconfigFileResolvesRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.yaml")
+	writeKubeconfig(t, path, "a")
+
+	info, err := clusterFromKubeconfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GetClusterName() != "a" {
+		t.Errorf("cluster name = %s, want a", info.GetClusterName())
+	}
+	// the CA file is read relative to the kubeconfig, and inlined so that its rotation is detected
+	if cfg := info.RestConfig(); string(cfg.CAData) != "ca" || cfg.CAFile != "" {
+		t.Errorf("CA data %q, CA file %q, want the content of certs/ca.crt inlined", cfg.CAData, cfg.CAFile)
+	}
+}
+
+func TestDirectoryClusterProviderRejectsNameCollisions(t *testing.T) {
+	dir := t.TempDir()
+	writeKubeconfig(t, filepath.Join(dir, "a.yaml"), "first")
+	writeKubeconfig(t, filepath.Join(dir, "a.yml"), "second")
+
+	p := NewDirectoryClusterProvider(dir)
+	ctx := context.Background()
+	events := make(chan ClusterEvent, 10)
+	known := map[string]kubeconfigFile{}
+	if err := p.rescan(ctx, events, known); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want only the first file of cluster a", len(events))
+	}
+	e := <-events
+	if e.Type != ClusterAdded || e.Cluster.RestConfig().Host != "https://first.example.com" {
+		t.Fatalf("unexpected event %s for %s", e.Type, e.Cluster.RestConfig().Host)
+	}
+
+	// removing the first file hands the cluster over to the second one
+	if err := os.Remove(filepath.Join(dir, "a.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.rescan(ctx, events, known); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Type != ClusterRemoved || e.Cluster.GetClusterName() != "a" {
+		t.Fatalf("unexpected event %s for %s", e.Type, e.Cluster.GetClusterName())
+	}
+	if e := <-events; e.Type != ClusterAdded || e.Cluster.RestConfig().Host != "https://second.example.com" {
+		t.Fatalf("unexpected event %s for %s", e.Type, e.Cluster.RestConfig().Host)
+	}
+}
+
+// nextDirectoryEvent returns the next event of a DirectoryClusterProvider, failing the test if there is none in time.
+func nextDirectoryEvent(t *testing.T, events <-chan ClusterEvent) ClusterEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a cluster event")
+		return ClusterEvent{}
+	}
+}
+
+// noDirectoryEvent fails the test if the DirectoryClusterProvider sends an event after its rescan delay.
+func noDirectoryEvent(t *testing.T, events <-chan ClusterEvent) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %s event of %s", e.Type, e.Cluster.GetClusterName())
+	case <-time.After(3 * directoryRescanDelay):
+	}
+}
+
+// expectDirectoryEvent fails the test unless the next event is of the given type, cluster and host.
+func expectDirectoryEvent(t *testing.T, events <-chan ClusterEvent, typ ClusterEventType, cluster, host string) ClusterEvent {
+	t.Helper()
+	e := nextDirectoryEvent(t, events)
+	if e.Type != typ || e.Cluster.GetClusterName() != cluster {
+		t.Fatalf("%s event of %s, want %s of %s", e.Type, e.Cluster.GetClusterName(), typ, cluster)
+	}
+	if host != "" && e.Cluster.RestConfig().Host != "https://"+host+".example.com" {
+		t.Fatalf("%s event of %s with host %s, want %s", e.Type, cluster, e.Cluster.RestConfig().Host, host)
+	}
+	return e
+}
+
+func TestDirectoryClusterProviderRun(t *testing.T) {
+	dir := t.TempDir()
+	writeKubeconfig(t, filepath.Join(dir, "a.yaml"), "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan ClusterEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- NewDirectoryClusterProvider(dir).Run(ctx, events)
+	}()
+	expectDirectoryEvent(t, events, ClusterAdded, "a", "a")
+
+	// edit
+	writeKubeconfig(t, filepath.Join(dir, "a.yaml"), "edited")
+	expectDirectoryEvent(t, events, ClusterUpdated, "a", "edited")
+	// a write that does not change the file
+	writeKubeconfig(t, filepath.Join(dir, "a.yaml"), "edited")
+	noDirectoryEvent(t, events)
+
+	// add, and recreate by renaming a hidden file over it, like an atomic write
+	writeKubeconfig(t, filepath.Join(dir, "b.yaml"), "b")
+	expectDirectoryEvent(t, events, ClusterAdded, "b", "b")
+	writeKubeconfig(t, filepath.Join(dir, ".b.yaml.tmp"), "recreated")
+	noDirectoryEvent(t, events)
+	if err := os.Rename(filepath.Join(dir, ".b.yaml.tmp"), filepath.Join(dir, "b.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	expectDirectoryEvent(t, events, ClusterUpdated, "b", "recreated")
+
+	// rotating the CA the kubeconfigs refer to updates both clusters
+	if err := os.WriteFile(filepath.Join(dir, "certs", "ca.crt"), []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rotated := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		e := nextDirectoryEvent(t, events)
+		if e.Type != ClusterUpdated || string(e.Cluster.RestConfig().CAData) != "rotated" {
+			t.Fatalf("%s event of %s with CA %q, want the rotated CA", e.Type, e.Cluster.GetClusterName(), e.Cluster.RestConfig().CAData)
+		}
+		rotated[e.Cluster.GetClusterName()] = true
+	}
+	if !rotated["a"] || !rotated["b"] {
+		t.Errorf("clusters updated with the rotated CA: %v", rotated)
+	}
+
+	// delete
+	if err := os.Remove(filepath.Join(dir, "b.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	expectDirectoryEvent(t, events, ClusterRemoved, "b", "")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return once its context was done")
+	}
+}
@@ -0,0 +1,306 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// ClusterState is the connectivity state of a watched cluster.
+type ClusterState string
+
+const (
+	// ClusterStateUnknown is the state of a cluster that was not probed yet.
+	ClusterStateUnknown ClusterState = "Unknown"
+	// ClusterStateReachable is the state of a ready cluster without any cache to sync.
+	ClusterStateReachable ClusterState = "Reachable"
+	// ClusterStateSyncing is the state of a ready cluster whose caches are not all synced yet.
+	ClusterStateSyncing ClusterState = "Syncing"
+	// ClusterStateSynced is the state of a ready cluster whose caches are all synced.
+	ClusterStateSynced ClusterState = "Synced"
+	// ClusterStateDegraded is the state of a cluster that failed its last probes,
+	// but fewer times in a row than the failure threshold.
+	ClusterStateDegraded ClusterState = "Degraded"
+	// ClusterStateLost is the state of a cluster that failed as many probes in a row as the failure threshold.
+	ClusterStateLost ClusterState = "Lost"
+)
+
+// clusterStates lists every ClusterState, for metrics.ClusterHealthState.
+var clusterStates = []ClusterState{
+	ClusterStateUnknown,
+	ClusterStateReachable,
+	ClusterStateSyncing,
+	ClusterStateSynced,
+	ClusterStateDegraded,
+	ClusterStateLost,
+}
+
+// recordClusterState sets the health state of a cluster in metrics.ClusterHealthState.
+func recordClusterState(cluster string, state ClusterState) {
+	for _, s := range clusterStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		metrics.ClusterHealthState.WithLabelValues(cluster, string(s)).Set(v)
+	}
+}
+
+// forgetClusterState removes the health state of a cluster from metrics.ClusterHealthState.
+func forgetClusterState(cluster string) {
+	for _, s := range clusterStates {
+		metrics.ClusterHealthState.DeleteLabelValues(cluster, string(s))
+	}
+}
+
+// setClusterState records the health state of the watch cw, unless it is stopped or replaced by a newer watch of its cluster.
+func (w *WatchJob) setClusterState(cw *clusterWatch, state ClusterState) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	if v, ok := w.clusters.Load(cw.name); !ok || v != cw || cw.ctx.Err() != nil {
+		return
+	}
+	recordClusterState(cw.name, state)
+}
+
+// forgetClusterState removes the health state and the other metric series of the watch cw once it is stopped,
+// unless a newer watch of its cluster already recorded its own.
+func (w *WatchJob) forgetClusterState(cw *clusterWatch) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	if v, ok := w.clusters.Load(cw.name); ok && v != cw {
+		return
+	}
+	forgetClusterState(cw.name)
+	for _, resource := range w.resources {
+		metrics.DeleteClusterSeries(cw.name, resourceGVK(resource).Kind)
+	}
+}
+
+// maxStateTransitions is the number of transitions kept in a ClusterHealth.
+const maxStateTransitions = 10
+
+// HealthCheckOptions configures the health monitor of every cluster of a WatchJob.
+type HealthCheckOptions struct {
+	// Interval is the period between two probes. Defaults to 10 seconds.
+	Interval time.Duration
+	// Timeout is the timeout of a probe. Defaults to 5 seconds.
+	Timeout time.Duration
+	// FailureThreshold is the number of failed probes in a row after which a cluster is lost.
+	// Defaults to 3.
+	FailureThreshold int
+}
+
+func (o HealthCheckOptions) withDefaults() HealthCheckOptions {
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 3
+	}
+	return o
+}
+
+// StateTransition records a change of the state of a cluster.
+type StateTransition struct {
+	From   ClusterState
+	To     ClusterState
+	Reason string
+	// Err is the probe error that caused the transition, if any.
+	Err  error
+	Time time.Time
+}
+
+// ClusterHealth is a snapshot of the health of a cluster.
+type ClusterHealth struct {
+	State              ClusterState
+	Reason             string
+	LastTransitionTime time.Time
+	LastProbeTime      time.Time
+	// ConsecutiveFailures is the number of failed probes since the last successful one.
+	ConsecutiveFailures int
+	// Transitions holds the latest transitions, oldest first.
+	Transitions []StateTransition
+}
+
+// HealthMonitor tracks the state of a cluster.
+// It probes the apiserver's /readyz endpoint periodically, and is told by the WatchJob when caches start and sync.
+type HealthMonitor struct {
+	cluster string
+	probe   func(ctx context.Context) error
+	HealthCheckOptions
+
+	mu     sync.Mutex
+	health ClusterHealth
+	// caches maps the caches of the cluster to whether they are synced.
+	caches       map[interface{}]bool
+	onTransition []func(cluster string, t StateTransition)
+	// pending holds the transitions not notified yet.
+	pending []StateTransition
+}
+
+// NewHealthMonitor creates a HealthMonitor probing the apiserver reached with cfg.
+func NewHealthMonitor(cluster string, cfg *rest.Config, o HealthCheckOptions) (*HealthMonitor, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	probe := func(ctx context.Context) error {
+		return dc.RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	}
+	return newHealthMonitor(cluster, probe, o), nil
+}
+
+func newHealthMonitor(cluster string, probe func(ctx context.Context) error, o HealthCheckOptions) *HealthMonitor {
+	return &HealthMonitor{
+		cluster:            cluster,
+		probe:              probe,
+		HealthCheckOptions: o.withDefaults(),
+		health:             ClusterHealth{State: ClusterStateUnknown},
+		caches:             map[interface{}]bool{},
+	}
+}
+
+// OnTransition registers f to be called after every state transition.
+func (m *HealthMonitor) OnTransition(f func(cluster string, t StateTransition)) {
+	m.mu.Lock()
+	m.onTransition = append(m.onTransition, f)
+	m.mu.Unlock()
+}
+
+// Run probes the cluster every Interval, until ctx is done.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		m.Probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe probes the cluster once and updates its state.
+func (m *HealthMonitor) Probe(ctx context.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx, m.Timeout)
+	err := m.probe(probeCtx)
+	cancel()
+	if ctx.Err() != nil {
+		// the probe was interrupted because the cluster is no longer watched
+		return
+	}
+
+	m.mu.Lock()
+	m.health.LastProbeTime = time.Now()
+	if err != nil {
+		m.health.ConsecutiveFailures++
+		to := ClusterStateDegraded
+		if m.health.ConsecutiveFailures >= m.FailureThreshold {
+			to = ClusterStateLost
+		}
+		m.transition(to, fmt.Sprintf("readyz probe failed %d time(s): %s", m.health.ConsecutiveFailures, err.Error()), err)
+	} else {
+		m.health.ConsecutiveFailures = 0
+		m.transitionReady("readyz probe succeeded")
+	}
+	m.unlockAndNotify()
+}
+
+// CacheStarted records that the cache identified by key started syncing.
+func (m *HealthMonitor) CacheStarted(key interface{}) {
+	m.mu.Lock()
+	m.caches[key] = false
+	m.transitionReady("cache started")
+	m.unlockAndNotify()
+}
+
+// CacheSynced records that the cache identified by key is synced.
+func (m *HealthMonitor) CacheSynced(key interface{}) {
+	m.mu.Lock()
+	if _, ok := m.caches[key]; ok {
+		m.caches[key] = true
+		m.transitionReady("cache synced")
+	}
+	m.unlockAndNotify()
+}
+
+// CacheStopped records that the cache identified by key is no longer used.
+func (m *HealthMonitor) CacheStopped(key interface{}) {
+	m.mu.Lock()
+	delete(m.caches, key)
+	m.transitionReady("cache stopped")
+	m.unlockAndNotify()
+}
+
+// Health returns a snapshot of the health of the cluster.
+func (m *HealthMonitor) Health() ClusterHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.health
+	h.Transitions = append([]StateTransition(nil), m.health.Transitions...)
+	return h
+}
+
+// transitionReady moves a ready cluster to the state matching its caches.
+// It does nothing if the cluster is not known to be ready. m.mu must be held.
+func (m *HealthMonitor) transitionReady(reason string) {
+	if m.health.LastProbeTime.IsZero() || m.health.ConsecutiveFailures > 0 {
+		return
+	}
+	to := ClusterStateReachable
+	if len(m.caches) > 0 {
+		to = ClusterStateSynced
+		for _, synced := range m.caches {
+			if !synced {
+				to = ClusterStateSyncing
+				break
+			}
+		}
+	}
+	m.transition(to, reason, nil)
+}
+
+// transition moves the cluster to state to. m.mu must be held.
+func (m *HealthMonitor) transition(to ClusterState, reason string, err error) {
+	from := m.health.State
+	if from == to {
+		if to == ClusterStateDegraded || to == ClusterStateLost {
+			// keep the latest error
+			m.health.Reason = reason
+		}
+		return
+	}
+	t := StateTransition{From: from, To: to, Reason: reason, Err: err, Time: time.Now()}
+	m.health.State = to
+	m.health.Reason = reason
+	m.health.LastTransitionTime = t.Time
+	m.health.Transitions = append(m.health.Transitions, t)
+	if len(m.health.Transitions) > maxStateTransitions {
+		m.health.Transitions = m.health.Transitions[len(m.health.Transitions)-maxStateTransitions:]
+	}
+	m.pending = append(m.pending, t)
+}
+
+// unlockAndNotify unlocks m.mu and calls the OnTransition funcs for the pending transitions.
+func (m *HealthMonitor) unlockAndNotify() {
+	pending := m.pending
+	m.pending = nil
+	hooks := m.onTransition
+	m.mu.Unlock()
+
+	for _, t := range pending {
+		for i := range hooks {
+			hooks[i](m.cluster, t)
+		}
+	}
+}
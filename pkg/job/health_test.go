@@ -0,0 +1,272 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
+	"k8s.io/client-go/rest"
+)
+
+// flappingAPIServer is a fake apiserver whose /readyz fails while down is set.
+type flappingAPIServer struct {
+	*httptest.Server
+	down int32
+}
+
+func newFlappingAPIServer(t *testing.T) *flappingAPIServer {
+	t.Helper()
+	s := &flappingAPIServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.LoadInt32(&s.down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *flappingAPIServer) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&s.down, v)
+}
+
+func TestHealthMonitorStateMachine(t *testing.T) {
+	srv := newFlappingAPIServer(t)
+	m, err := NewHealthMonitor("a", &rest.Config{Host: srv.URL}, HealthCheckOptions{FailureThreshold: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transitions []StateTransition
+	m.OnTransition(func(cluster string, tr StateTransition) {
+		transitions = append(transitions, tr)
+	})
+	ctx := context.Background()
+	expect := func(step string, want ClusterState, failures int) {
+		t.Helper()
+		h := m.Health()
+		if h.State != want || h.ConsecutiveFailures != failures {
+			t.Fatalf("%s: state %s with %d failures, want %s with %d", step, h.State, h.ConsecutiveFailures, want, failures)
+		}
+	}
+
+	expect("before the first probe", ClusterStateUnknown, 0)
+	m.Probe(ctx)
+	expect("ready", ClusterStateReachable, 0)
+
+	m.CacheStarted("pods")
+	expect("cache started", ClusterStateSyncing, 0)
+	m.CacheSynced("pods")
+	expect("cache synced", ClusterStateSynced, 0)
+
+	srv.setDown(true)
+	m.Probe(ctx)
+	expect("first failure", ClusterStateDegraded, 1)
+	m.Probe(ctx)
+	expect("second failure", ClusterStateDegraded, 2)
+	// the caches do not make a failing cluster ready
+	m.CacheStarted("deployments")
+	expect("cache started while degraded", ClusterStateDegraded, 2)
+	m.Probe(ctx)
+	expect("failure threshold", ClusterStateLost, 3)
+
+	srv.setDown(false)
+	m.Probe(ctx)
+	expect("recovered", ClusterStateSyncing, 0)
+	m.CacheSynced("deployments")
+	expect("recovered and synced", ClusterStateSynced, 0)
+	m.CacheStopped("pods")
+	m.CacheStopped("deployments")
+	expect("caches stopped", ClusterStateReachable, 0)
+
+	want := []ClusterState{
+		ClusterStateReachable, ClusterStateSyncing, ClusterStateSynced, ClusterStateDegraded, ClusterStateLost,
+		ClusterStateSyncing, ClusterStateSynced, ClusterStateReachable,
+	}
+	if len(transitions) != len(want) {
+		t.Fatalf("got %d transitions, want %d: %v", len(transitions), len(want), transitions)
+	}
+	for i := range want {
+		if transitions[i].To != want[i] {
+			t.Errorf("transition %d to %s, want %s", i, transitions[i].To, want[i])
+		}
+	}
+	if transitions[3].Err == nil {
+		t.Error("a degraded transition must carry the probe error")
+	}
+	if got := len(m.Health().Transitions); got != len(want) {
+		t.Errorf("kept %d transitions, want %d", got, len(want))
+	}
+}
+
+func TestHealthMonitorFlapping(t *testing.T) {
+	srv := newFlappingAPIServer(t)
+	m, err := NewHealthMonitor("a", &rest.Config{Host: srv.URL}, HealthCheckOptions{
+		Interval:         5 * time.Millisecond,
+		FailureThreshold: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	seen := map[ClusterState]bool{}
+	m.OnTransition(func(cluster string, tr StateTransition) {
+		mu.Lock()
+		seen[tr.To] = true
+		mu.Unlock()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// flap until every state of the cycle was seen
+	deadline := time.Now().Add(10 * time.Second)
+	for down := true; ; down = !down {
+		mu.Lock()
+		done := seen[ClusterStateReachable] && seen[ClusterStateDegraded] && seen[ClusterStateLost]
+		states := fmt.Sprint(seen)
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("states seen while flapping: %s", states)
+		}
+		srv.setDown(down)
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	srv.setDown(false)
+	for m.Health().State != ClusterStateReachable {
+		if time.Now().After(deadline) {
+			t.Fatalf("cluster did not recover: %s", m.Health().State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// scrapeClusterState returns the health state series of cluster served by metrics.Handler.
+func scrapeClusterState(t *testing.T, cluster string) []string {
+	t.Helper()
+	var series []string
+	for _, line := range scrapeClusterSeries(t, cluster) {
+		if strings.HasPrefix(line, "mc_cluster_health_state{") {
+			series = append(series, line)
+		}
+	}
+	return series
+}
+
+// scrapeClusterSeries returns the scraped series of every metric labeled by the cluster.
+func scrapeClusterSeries(t *testing.T, cluster string) []string {
+	t.Helper()
+	srv := httptest.NewServer(metrics.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.Contains(line, `{cluster="`+cluster+`"`) {
+			series = append(series, line)
+		}
+	}
+	return series
+}
+
+func TestClusterStateMetricsOfRestartedCluster(t *testing.T) {
+	w, _, newCluster := newLifecycleTestJob(t)
+	defer w.StopWatch()
+	waitForState := func(what string) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); len(scrapeClusterState(t, "a")) == 0; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no health state scraped %s", what)
+			}
+		}
+	}
+
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitForState("once the cluster is started")
+	v, _ := w.clusters.Load("a")
+	previous := v.(*clusterWatch)
+
+	// the cluster is restarted before its previous watch is stopped
+	w.StopResourceWatch(newCluster("a"))
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitForState("once the cluster is restarted")
+	waitFor(t, "the previous watch to stop", previous.done)
+	// the previous watch may only forget its state after the new one recorded its own
+	w.forgetClusterState(previous)
+	if series := scrapeClusterState(t, "a"); len(series) != len(clusterStates) {
+		t.Fatalf("health state of the restarted cluster = %v", series)
+	}
+
+	w.StopResourceWatchAndDrain(newCluster("a"))
+	if series := scrapeClusterState(t, "a"); len(series) != 0 {
+		t.Errorf("health state of the stopped cluster = %v", series)
+	}
+}
+
+func TestClusterSeriesDeletedWithCluster(t *testing.T) {
+	srv := newPodAPIServer(t, "x")
+	r := &reconcileRecorder{}
+	w, newCluster := newPodTestJob(t, srv, r)
+	if err := w.AddResourceWatch(newCluster("series")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the pod to be reconciled", r.reconciledPod("series", "x"))
+	hasSeries := func(metric string) func() bool {
+		return func() bool {
+			for _, line := range scrapeClusterSeries(t, "series") {
+				if strings.HasPrefix(line, metric+"{") {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	for _, metric := range []string{
+		"mc_controller_reconcile_total",
+		"mc_controller_reconcile_duration_seconds_count",
+		"mc_workqueue_adds_total",
+		"mc_workqueue_depth",
+		"mc_workqueue_queue_duration_seconds_count",
+		"mc_cache_sync_duration_seconds_count",
+		"mc_cluster_health_state",
+	} {
+		waitUntil(t, metric+" of the cluster", hasSeries(metric))
+	}
+
+	w.StopResourceWatchAndDrain(newCluster("series"))
+	if series := scrapeClusterSeries(t, "series"); len(series) > 0 {
+		t.Errorf("series of the removed cluster are still scraped: %v", series)
+	}
+}
@@ -0,0 +1,251 @@
+package job
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/cluster"
+	"github.com/wangguoyan/mc-operator/pkg/controller"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// ClusterStatus is a snapshot of the state of a watched cluster.
+type ClusterStatus struct {
+	Name      string
+	Labels    map[string]string
+	StartedAt time.Time
+	Health    ClusterHealth
+	// Synced reports whether the informers of all active resources are synced.
+	Synced bool
+	// LastEventTime is the time of the latest event of any resource.
+	LastEventTime time.Time
+	// LastReconcileTime is the end time of the latest reconcile of any resource.
+	LastReconcileTime time.Time
+	// QueueDepth is the number of requests waiting to be reconciled, over all resources.
+	QueueDepth int
+	Resources  []ResourceStatus
+}
+
+// ResourceStatus is a snapshot of the state of a resource watched in a cluster.
+type ResourceStatus struct {
+	GroupVersionKind schema.GroupVersionKind
+	// Active reports whether the watch is running. It is false while a failed watch waits to be restarted.
+	Active bool
+	// Synced reports whether the informers of the resource, and of its owner if any, are synced.
+	Synced bool
+	// Restarts is the number of times the watch was restarted after a failure.
+	Restarts int
+	// LastError is the latest error of the watch, if any.
+	LastError         error
+	LastEventTime     time.Time
+	LastReconcileTime time.Time
+	// QueueDepth is the number of requests waiting to be reconciled.
+	QueueDepth int
+}
+
+// resourceWatch is a resource watched in a cluster.
+type resourceWatch struct {
+	cluster  string
+	resource *WatchResource
+	cfg      *rest.Config
+	health   *HealthMonitor
+	cancel   context.CancelFunc
+	// abandon records the Requests abandoned when the watch stopped.
+	abandon func(keys []reconcile.Key)
+	// controllerOptions and cacheOptions are the options of the resource merged with those of the cluster.
+	controllerOptions controller.Options
+	cacheOptions      cluster.CacheOptions
+
+	// lastEvent and lastReconcile are the unix nanoseconds of the latest event and reconcile,
+	// updated atomically on every event and reconcile.
+	lastEvent     int64
+	lastReconcile int64
+
+	mu       sync.Mutex
+	active   bool
+	restarts int
+	lastErr  error
+	// depth and synced are set while the watch is active.
+	depth  func() int
+	synced func() bool
+}
+
+// unixTime returns the time of the given unix nanoseconds, or the zero time for 0.
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+func (rw *resourceWatch) status() ResourceStatus {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	s := ResourceStatus{
+		GroupVersionKind:  resourceGVK(rw.resource),
+		Active:            rw.active,
+		Restarts:          rw.restarts,
+		LastError:         rw.lastErr,
+		LastEventTime:     unixTime(atomic.LoadInt64(&rw.lastEvent)),
+		LastReconcileTime: unixTime(atomic.LoadInt64(&rw.lastReconcile)),
+	}
+	if rw.depth != nil {
+		s.QueueDepth = rw.depth()
+	}
+	if rw.synced != nil {
+		s.Synced = rw.synced()
+	}
+	return s
+}
+
+// started records that an attempt of the watch started, with a func returning the depth of its queue,
+// and returns the function recording its end.
+func (rw *resourceWatch) started(depth func() int) (stopped func(err error)) {
+	rw.mu.Lock()
+	rw.active = true
+	rw.depth = depth
+	rw.mu.Unlock()
+	return func(err error) {
+		rw.mu.Lock()
+		rw.active = false
+		rw.depth = nil
+		rw.synced = nil
+		if err != nil {
+			rw.lastErr = err
+		}
+		rw.mu.Unlock()
+	}
+}
+
+func (rw *resourceWatch) setSynced(synced func() bool) {
+	rw.mu.Lock()
+	rw.synced = synced
+	rw.mu.Unlock()
+}
+
+func (rw *resourceWatch) restarted() {
+	rw.mu.Lock()
+	rw.restarts++
+	rw.mu.Unlock()
+}
+
+// watchOf returns the watch of a resource in the given cluster, or nil if it is not watched.
+type watchOf func(clusterName string) *resourceWatch
+
+// statsQueue records the time of the events added by the event handlers
+// in the watch of the Request's cluster, without taking any lock.
+type statsQueue struct {
+	workqueue.RateLimitingInterface
+	watchOf watchOf
+}
+
+func (q statsQueue) Add(item interface{}) {
+	if key, ok := item.(reconcile.Key); ok {
+		if rw := q.watchOf(key.ClusterName); rw != nil {
+			atomic.StoreInt64(&rw.lastEvent, time.Now().UnixNano())
+		}
+	}
+	q.RateLimitingInterface.Add(item)
+}
+
+// DropCluster implements controller.ClusterDropper if the wrapped queue does.
+func (q statsQueue) DropCluster(cluster string) []interface{} {
+	if d, ok := q.RateLimitingInterface.(controller.ClusterDropper); ok {
+		return d.DropCluster(cluster)
+	}
+	return nil
+}
+
+// statsReconciler records the time of the reconciles in the watch of the Request's cluster.
+type statsReconciler struct {
+	reconcile.ContextReconciler
+	watchOf watchOf
+}
+
+func (r statsReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	defer func() {
+		if rw := r.watchOf(req.GetClusterName()); rw != nil {
+			atomic.StoreInt64(&rw.lastReconcile, time.Now().UnixNano())
+		}
+	}()
+	return r.ContextReconciler.Reconcile(ctx, req)
+}
+
+// newController creates a controller for resource recording the stats of its watches, found with watchOf.
+// o.Queue defaults to a rate limiting queue.
+func (w *WatchJob) newController(resource *WatchResource, o controller.Options, watchOf watchOf) *controller.Controller {
+	o.Kind = resourceGVK(resource).Kind
+	if o.Queue == nil {
+		if o.RateLimiter == nil {
+			o.RateLimiter = workqueue.DefaultControllerRateLimiter()
+		}
+		o.Queue = controller.NewQueue(o.RateLimiter, o.Kind)
+	}
+	o.Queue = statsQueue{RateLimitingInterface: o.Queue, watchOf: watchOf}
+	if o.Logger.GetSink() == nil {
+		o.Logger = w.logger
+	}
+	o.Logger = o.Logger.WithValues("gvk", resourceGVK(resource))
+	r := statsReconciler{ContextReconciler: resource.contextReconciler(), watchOf: watchOf}
+	return controller.NewWithContext(r, o)
+}
+
+// ListClusters returns the names of the watched clusters, sorted.
+func (w *WatchJob) ListClusters() []string {
+	var names []string
+	w.clusters.Range(func(key interface{}, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// GetClusterStatus returns the status of a watched cluster and of the resources watched in it.
+func (w *WatchJob) GetClusterStatus(name string) (ClusterStatus, bool) {
+	v, ok := w.clusters.Load(name)
+	if !ok {
+		return ClusterStatus{}, false
+	}
+	cw := v.(*clusterWatch)
+
+	cw.mu.Lock()
+	s := ClusterStatus{
+		Name:      name,
+		Labels:    cw.info.GetLabels(),
+		StartedAt: cw.startedAt,
+		Health:    ClusterHealth{State: ClusterStateUnknown},
+	}
+	health := cw.health
+	watches := make([]*resourceWatch, 0, len(cw.resources))
+	for i := range w.resources {
+		if rw, ok := cw.resources[w.resources[i]]; ok {
+			watches = append(watches, rw)
+		}
+	}
+	cw.mu.Unlock()
+
+	if health != nil {
+		s.Health = health.Health()
+	}
+	s.Synced = len(watches) > 0
+	for _, rw := range watches {
+		rs := rw.status()
+		s.Resources = append(s.Resources, rs)
+		s.Synced = s.Synced && rs.Active && rs.Synced
+		s.QueueDepth += rs.QueueDepth
+		if rs.LastEventTime.After(s.LastEventTime) {
+			s.LastEventTime = rs.LastEventTime
+		}
+		if rs.LastReconcileTime.After(s.LastReconcileTime) {
+			s.LastReconcileTime = rs.LastReconcileTime
+		}
+	}
+	return s, true
+}
@@ -0,0 +1,155 @@
+package job
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// blockingReconciler blocks every reconcile until it is released, or its context is done.
+type blockingReconciler struct {
+	started chan reconcile.Key
+	release chan struct{}
+}
+
+func newBlockingReconciler() *blockingReconciler {
+	return &blockingReconciler{started: make(chan reconcile.Key, 100), release: make(chan struct{})}
+}
+
+func (r *blockingReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	r.started <- req.Key
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+	}
+	return reconcile.Result{}, nil
+}
+
+func (r *blockingReconciler) unblock() {
+	select {
+	case <-r.release:
+	default:
+		close(r.release)
+	}
+}
+
+// podStatus returns the status of the cluster, and of the pods watched in it.
+// It returns an empty status until the pods are watched.
+func podStatus(w *WatchJob, name string) (ClusterStatus, ResourceStatus) {
+	s, ok := w.GetClusterStatus(name)
+	if !ok || len(s.Resources) != 1 {
+		return ClusterStatus{}, ResourceStatus{}
+	}
+	return s, s.Resources[0]
+}
+
+func TestGetClusterStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		shared bool
+	}{
+		{name: "per cluster controllers"},
+		{name: "shared controllers", shared: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newPodAPIServer(t, "x")
+			r := newBlockingReconciler()
+			w, _ := newPodTestJob(t, srv, r)
+			// released before the job is drained by the cleanup of newPodTestJob
+			t.Cleanup(r.unblock)
+			if tc.shared {
+				w.WithSharedControllers(1)
+			}
+			if _, ok := w.GetClusterStatus("a"); ok {
+				t.Fatal("status of a cluster that is not watched")
+			}
+			before := time.Now()
+			info := NewClusterWithCfg("a", &rest.Config{Host: srv.URL}, WithLabels(map[string]string{"env": "test"}))
+			if err := w.AddResourceWatch(info); err != nil {
+				t.Fatal(err)
+			}
+
+			// the first reconcile blocks the only worker, the next pods wait in the queue
+			select {
+			case <-r.started:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the first reconcile")
+			}
+			srv.addPod("y")
+			srv.addPod("z")
+			waitUntil(t, "two queued pods", func() bool {
+				s, _ := podStatus(w, "a")
+				return s.QueueDepth == 2
+			})
+			s, rs := podStatus(w, "a")
+			if s.Name != "a" || !reflect.DeepEqual(s.Labels, map[string]string{"env": "test"}) || s.StartedAt.Before(before) {
+				t.Errorf("cluster %s with labels %v started at %s", s.Name, s.Labels, s.StartedAt)
+			}
+			if !s.Synced || s.Health.State != ClusterStateSynced {
+				t.Errorf("synced %t in state %s, want the cluster synced", s.Synced, s.Health.State)
+			}
+			if rs.GroupVersionKind != corev1.SchemeGroupVersion.WithKind("Pod") || !rs.Active || !rs.Synced {
+				t.Errorf("resource %v active %t, synced %t", rs.GroupVersionKind, rs.Active, rs.Synced)
+			}
+			if rs.QueueDepth != 2 || rs.Restarts != 0 || rs.LastError != nil {
+				t.Errorf("resource queue depth %d, %d restarts, error %v", rs.QueueDepth, rs.Restarts, rs.LastError)
+			}
+			if rs.LastEventTime.Before(before) || s.LastEventTime != rs.LastEventTime {
+				t.Errorf("last event at %s, %s for the cluster", rs.LastEventTime, s.LastEventTime)
+			}
+			if !rs.LastReconcileTime.IsZero() {
+				t.Errorf("last reconcile at %s, want none ended yet", rs.LastReconcileTime)
+			}
+
+			r.unblock()
+			waitUntil(t, "the queue to be empty", func() bool {
+				s, rs := podStatus(w, "a")
+				return rs.Active && s.QueueDepth == 0 && !s.LastReconcileTime.IsZero()
+			})
+			if got := w.ListClusters(); !reflect.DeepEqual(got, []string{"a"}) {
+				t.Errorf("clusters %v, want a", got)
+			}
+			w.StopResourceWatchAndDrain(info)
+			if _, ok := w.GetClusterStatus("a"); ok {
+				t.Error("status of a stopped cluster")
+			}
+		})
+	}
+}
+
+func TestGetClusterStatusOfFailedWatch(t *testing.T) {
+	srv := newPodAPIServer(t, "x")
+	srv.setDown(true)
+	r := &reconcileRecorder{}
+	w, newCluster := newPodTestJob(t, srv, r)
+	w.WithRestartPolicy(RestartPolicy{InitialBackoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, "the watch to be restarted", func() bool {
+		_, rs := podStatus(w, "a")
+		return rs.Restarts > 0
+	})
+	s, rs := podStatus(w, "a")
+	if s.Synced || rs.Synced || rs.LastError == nil {
+		t.Errorf("failed watch synced %t with error %v, cluster synced %t", rs.Synced, rs.LastError, s.Synced)
+	}
+
+	srv.setDown(false)
+	waitUntil(t, "the pod to be reconciled", r.reconciledPod("a", "x"))
+	waitUntil(t, "the watch to be synced", func() bool {
+		s, _ := podStatus(w, "a")
+		return s.Synced
+	})
+	_, rs = podStatus(w, "a")
+	if !rs.Active || !rs.Synced || rs.Restarts == 0 || rs.LastError == nil {
+		t.Errorf("restarted watch active %t, synced %t after %d restarts, want its last error %v kept",
+			rs.Active, rs.Synced, rs.Restarts, rs.LastError)
+	}
+}
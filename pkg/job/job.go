@@ -1,34 +1,109 @@
 package job
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
 	"github.com/wangguoyan/mc-operator/pkg/cluster"
 	"github.com/wangguoyan/mc-operator/pkg/controller"
 	"github.com/wangguoyan/mc-operator/pkg/manager"
+	"github.com/wangguoyan/mc-operator/pkg/metrics"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
 	"github.com/wangguoyan/mc-operator/pkg/util"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sync"
+	"time"
 )
 
+// ErrJobStopped is returned when clusters are added to a WatchJob after StopWatch.
+var ErrJobStopped = errors.New("watch job is stopped")
+
+// ErrShardingWithLeaderElection is returned when clusters are added to a WatchJob configured with both
+// WithSharding and WithLeaderElection. Such a job is stopped as soon as it starts.
+var ErrShardingWithLeaderElection = errors.New("sharding cannot be combined with leader election")
+
+// WatchJob watches its resources in a dynamic set of clusters.
+// The job has a single lifecycle: clusters can be added and removed at any time and in any order,
+// each with a context derived from the job's, until StopWatch stops every cluster at once.
 type WatchJob struct {
 	resources   []*WatchResource
-	restClient  *rest.RESTClient
-	mgrs        util.ThreadSafeMap
 	ctx         context.Context
 	cancel      context.CancelFunc
-	contexts    util.ThreadSafeMap
-	cancels     util.ThreadSafeMap
+	ctxOnce     sync.Once
+	wg          sync.WaitGroup
+	clusters    util.ThreadSafeMap
 	failedHooks []func(clusterName string, err error)
+	listeners   []ClusterLifecycleListener
+	health      HealthCheckOptions
+	// stateMu serializes the updates of metrics.ClusterHealthState, see setClusterState.
+	stateMu sync.Mutex
+	// restartPolicy is nil unless failed watches are restarted.
+	restartPolicy *RestartPolicy
+	// sharedWorkers is the number of workers of each shared controller, or 0 without shared controllers.
+	sharedWorkers     int
+	sharedMu          sync.Mutex
+	sharedControllers map[*WatchResource]*sharedController
+	fairness          controller.FairQueueOptions
+	logger            logr.Logger
+	// leaderElection is nil unless the replicas of the job elect a leader.
+	leaderElection *LeaderElectionOptions
+	// elected is closed once the controllers of the job may start.
+	elected chan struct{}
+	// sharding is nil unless the clusters are sharded across the replicas of the job.
+	// desired maps the names of the clusters of the job to their info, whether the replica owns them or not.
+	sharding *ShardingOptions
+	desired  util.ThreadSafeMap
+	// membershipMu serializes the changes of desired and clusters, so that a rebalance
+	// does not start a cluster removed concurrently, or with outdated info.
+	membershipMu sync.Mutex
+	shardMu      sync.RWMutex
+	shardMembers []string
+	ring         *util.HashRing
+	// err is the configuration error of the job, which stops it as soon as it starts.
+	err error
+}
+
+// clusterWatch is a watched cluster and the resources watched in it.
+type clusterWatch struct {
+	name      string
+	startedAt time.Time
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	// done is closed once the cluster and all its resources are no longer watched.
+	done chan struct{}
+
+	mu     sync.Mutex
+	info   ClusterInfoInterface
+	cfg    *rest.Config
+	health *HealthMonitor
+	// stateSince is when the cluster entered its current health state,
+	// or its first degraded state if it is still degraded.
+	stateSince time.Time
+	// resources maps the resources watched in the cluster to their watch.
+	resources map[*WatchResource]*resourceWatch
+	// abandoned are the Requests abandoned when the cluster was stopped.
+	abandoned []reconcile.Key
 }
 
 func NewWatchJob(res []*WatchResource) (*WatchJob, error) {
 	if len(res) == 0 {
 		return nil, errors.New("watch resource is empty")
 	}
+	for i := range res {
+		if err := res[i].validate(); err != nil {
+			return nil, err
+		}
+	}
 	watchJob := &WatchJob{
 		resources: res,
+		logger:    klog.Background(),
 	}
 	return watchJob, nil
 }
@@ -40,104 +115,639 @@ func (w *WatchJob) AddFailedRollBack(f ...func(clusterName string, err error)) *
 	return w
 }
 
+// WithLogger sets the logger of the job, klog.Background() by default.
+// The loggers of the controllers, clusters and providers of the job are derived from it.
+// It must be called before the job starts watching clusters.
+func (w *WatchJob) WithLogger(l logr.Logger) *WatchJob {
+	w.logger = l
+	return w
+}
+
+// WithHealthCheck configures the health monitors of the clusters started afterwards.
+func (w *WatchJob) WithHealthCheck(o HealthCheckOptions) *WatchJob {
+	w.health = o
+	return w
+}
+
+// GetClusterHealth returns the health of a watched cluster.
+func (w *WatchJob) GetClusterHealth(name string) (ClusterHealth, bool) {
+	v, ok := w.clusters.Load(name)
+	if !ok {
+		return ClusterHealth{}, false
+	}
+	cw := v.(*clusterWatch)
+	cw.mu.Lock()
+	health := cw.health
+	cw.mu.Unlock()
+	if health == nil {
+		return ClusterHealth{State: ClusterStateUnknown}, true
+	}
+	return health.Health(), true
+}
+
+// StartResourceWatch starts watching the given clusters and blocks until all of them are stopped.
+// Clusters that are already watched are not restarted.
 func (w *WatchJob) StartResourceWatch(clusters ...ClusterInfoInterface) {
 	if clusters == nil || len(clusters) == 0 {
-		klog.Errorf("cluster should be nil")
+		w.logger.Error(nil, "No cluster to watch")
 	}
 	w.doResourceWatch(clusters...)
 }
 
-func (w *WatchJob) StopResourceWatch(clusters ...ClusterInfoInterface) {
+// AddResourceWatch starts watching the given clusters in the background, and returns immediately.
+// It can be called at any time until StopWatch, to grow the set of clusters of a running job.
+// Clusters that are already watched are not restarted.
+func (w *WatchJob) AddResourceWatch(clusters ...ClusterInfoInterface) error {
+	if err := w.stopped(); err != nil {
+		return err
+	}
 	for i := range clusters {
-		c := clusters[i]
-		v, ok := w.cancels.Load(c.GetClusterName())
-		if ok {
-			v.(context.CancelFunc)()
+		w.addCluster(clusters[i])
+	}
+	return nil
+}
+
+// UpdateResourceWatch applies new info of already watched clusters.
+// If only the labels of a cluster changed, the resources whose ClusterSelector no longer matches are stopped,
+// and the newly matching ones are started. Otherwise, the cluster is restarted with the new connection info.
+// Clusters that are not watched yet are started.
+func (w *WatchJob) UpdateResourceWatch(clusters ...ClusterInfoInterface) error {
+	if err := w.stopped(); err != nil {
+		return err
+	}
+	for i := range clusters {
+		w.updateCluster(clusters[i])
+	}
+	return nil
+}
+
+// updateCluster applies new info of a cluster, like UpdateResourceWatch.
+func (w *WatchJob) updateCluster(info ClusterInfoInterface) {
+	w.membershipMu.Lock()
+	defer w.membershipMu.Unlock()
+	if w.sharding != nil {
+		w.desired.Store(info.GetClusterName(), info)
+		if !w.owns(info.GetClusterName()) {
+			return
+		}
+	}
+	if v, ok := w.clusters.Load(info.GetClusterName()); ok {
+		cw := v.(*clusterWatch)
+		cw.mu.Lock()
+		same := sameConnection(cw.info, info)
+		cw.mu.Unlock()
+		if same {
+			w.syncClusterResources(cw, info)
+			return
 		}
-		w.cancels.Delete(c.GetClusterName())
-		w.contexts.Delete(c.GetClusterName())
+		w.stopCluster(info.GetClusterName())
+	}
+	w.startCluster(info)
+}
+
+// WatchClusterProvider subscribes the job to p: clusters are started when p reports them added,
+// updated with UpdateResourceWatch when p reports them updated, and stopped when removed.
+// It blocks until StopWatch is called or p fails.
+func (w *WatchJob) WatchClusterProvider(p ClusterProvider) error {
+	ctx := w.jobContext()
+	events := make(chan ClusterEvent)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.Run(ctx, events)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return w.err
+		case err := <-errCh:
+			return err
+		case e := <-events:
+			w.handleClusterEvent(e)
+		}
+	}
+}
+
+func (w *WatchJob) handleClusterEvent(e ClusterEvent) {
+	if e.Cluster == nil {
+		return
+	}
+	switch e.Type {
+	case ClusterAdded, ClusterUpdated:
+		_ = w.UpdateResourceWatch(e.Cluster)
+	case ClusterRemoved:
+		w.StopResourceWatch(e.Cluster)
+	default:
+		w.logger.Error(nil, "Unknown cluster event type", "type", e.Type, "cluster", e.Cluster.GetClusterName())
 	}
-	if w.cancels.Size() == 0 {
-		w.cancel()
+}
+
+// StopResourceWatch stops watching the given clusters. The other clusters and the job keep running.
+func (w *WatchJob) StopResourceWatch(clusters ...ClusterInfoInterface) {
+	for i := range clusters {
+		w.removeCluster(clusters[i].GetClusterName())
 	}
 }
 
+// removeCluster removes the cluster from the desired clusters of the job and stops watching it.
+// It returns its watch, or nil if it was not watched.
+func (w *WatchJob) removeCluster(name string) *clusterWatch {
+	w.membershipMu.Lock()
+	defer w.membershipMu.Unlock()
+	w.desired.Delete(name)
+	return w.stopCluster(name)
+}
+
+// stopCluster stops watching the cluster, and returns its watch, or nil if it was not watched.
+// It must be called with membershipMu held.
+func (w *WatchJob) stopCluster(name string) *clusterWatch {
+	v, ok := w.clusters.LoadAndDelete(name)
+	if !ok {
+		return nil
+	}
+	cw := v.(*clusterWatch)
+	cw.cancel()
+	return cw
+}
+
+// StopResourceWatchAndDrain stops watching the given clusters like StopResourceWatch,
+// and blocks until they are no longer watched: the running reconciles of their Requests have finished,
+// or were cancelled after the grace period of their controller (controller.Options.GracePeriod).
+// It returns the abandoned Requests: those still queued, and those whose reconcile was cancelled.
+func (w *WatchJob) StopResourceWatchAndDrain(clusters ...ClusterInfoInterface) []reconcile.Key {
+	var watches []*clusterWatch
+	for i := range clusters {
+		if cw := w.removeCluster(clusters[i].GetClusterName()); cw != nil {
+			watches = append(watches, cw)
+		}
+	}
+	return drainClusters(watches)
+}
+
+// StopWatch stops watching every cluster and ends the job. Clusters can no longer be added afterwards.
 func (w *WatchJob) StopWatch() {
+	w.jobContext()
 	w.cancel()
 }
 
-func (w *WatchJob) getCtxForClusterName(name string) context.Context {
-	v, ok := w.contexts.Load(name)
-	if ok {
-		return v.(context.Context)
+// StopWatchAndDrain stops the job like StopWatch, and blocks until its clusters are drained
+// like with StopResourceWatchAndDrain. It returns the abandoned Requests of every cluster.
+func (w *WatchJob) StopWatchAndDrain() []reconcile.Key {
+	var watches []*clusterWatch
+	w.clusters.Range(func(_ interface{}, v interface{}) bool {
+		watches = append(watches, v.(*clusterWatch))
+		return true
+	})
+	w.StopWatch()
+	abandoned := drainClusters(watches)
+	w.wg.Wait()
+	return abandoned
+}
+
+// drainClusters waits for the stopped clusters to be no longer watched, and returns their abandoned Requests.
+func drainClusters(watches []*clusterWatch) []reconcile.Key {
+	var abandoned []reconcile.Key
+	for _, cw := range watches {
+		<-cw.done
+		cw.mu.Lock()
+		abandoned = append(abandoned, cw.abandoned...)
+		cw.mu.Unlock()
+	}
+	return abandoned
+}
+
+// Wait blocks until the job is stopped and all its clusters are no longer watched.
+func (w *WatchJob) Wait() {
+	<-w.jobContext().Done()
+	w.wg.Wait()
+}
+
+// jobContext returns the context shared by every cluster of the job, creating it on first use.
+func (w *WatchJob) jobContext() context.Context {
+	w.ctxOnce.Do(func() {
+		w.ctx, w.cancel = context.WithCancel(logr.NewContext(context.Background(), w.logger))
+		w.elected = make(chan struct{})
+		if w.err != nil {
+			w.logger.Error(w.err, "Invalid watch job, stop it")
+			w.cancel()
+			return
+		}
+		if w.leaderElection == nil {
+			close(w.elected)
+		} else {
+			go w.runLeaderElection(w.ctx)
+		}
+		if w.sharding != nil {
+			go w.runSharding(w.ctx)
+		}
+	})
+	return w.ctx
+}
+
+// stopped returns the reason why clusters can no longer be added to the job, or nil if they can.
+func (w *WatchJob) stopped() error {
+	if w.jobContext().Err() == nil {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
 	}
-	ctx, cancel := context.WithCancel(w.ctx)
-	w.contexts.Store(name, ctx)
-	w.cancels.Store(name, cancel)
-	return ctx
+	return ErrJobStopped
 }
-func (w *WatchJob) getMgrByClusterName(name string) *manager.Manager {
-	v, ok := w.mgrs.Load(name)
-	if ok {
-		return v.(*manager.Manager)
+
+// addCluster starts watching the cluster like startCluster, unless the job is sharded and the replica
+// does not own it. It returns nil in this case. The clusters of a sharded job are recorded as desired either way.
+func (w *WatchJob) addCluster(info ClusterInfoInterface) *clusterWatch {
+	w.membershipMu.Lock()
+	defer w.membershipMu.Unlock()
+	if w.sharding != nil {
+		w.desired.Store(info.GetClusterName(), info)
+		if !w.owns(info.GetClusterName()) {
+			return nil
+		}
 	}
-	mgr := manager.New()
-	w.mgrs.Store(name, mgr)
-	return mgr
+	return w.startCluster(info)
+}
+
+// startCluster starts watching the cluster in the background, unless it is already watched.
+// It returns the cluster's watch in both cases. It must be called with membershipMu held.
+func (w *WatchJob) startCluster(info ClusterInfoInterface) *clusterWatch {
+	cw := &clusterWatch{
+		name:      info.GetClusterName(),
+		startedAt: time.Now(),
+		info:      info,
+		done:      make(chan struct{}),
+		resources: map[*WatchResource]*resourceWatch{},
+	}
+	ctx := logr.NewContext(w.jobContext(), w.logger.WithValues("cluster", info.GetClusterName()))
+	cw.ctx, cw.cancel = context.WithCancel(ctx)
+	v, loaded := w.clusters.LoadOrStore(info.GetClusterName(), cw)
+	if loaded {
+		cw.cancel()
+		return v.(*clusterWatch)
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer close(cw.done)
+		w.watchCluster(cw, info)
+		w.membershipMu.Lock()
+		w.clusters.CompareAndDelete(info.GetClusterName(), cw)
+		w.membershipMu.Unlock()
+	}()
+	return cw
 }
 
 // 创建并启动指定集群监听
 func (w *WatchJob) doResourceWatch(clusterInfos ...ClusterInfoInterface) {
-	w.ctx, w.cancel = context.WithCancel(context.Background())
+	if err := w.stopped(); err != nil {
+		w.logger.Error(err, "Start resource watch failed")
+		return
+	}
+	watches := make([]*clusterWatch, 0, len(clusterInfos))
+	for i := range clusterInfos {
+		if cw := w.addCluster(clusterInfos[i]); cw != nil {
+			watches = append(watches, cw)
+		}
+	}
+	if w.sharding != nil {
+		// the clusters can move between replicas, they are stopped with the job
+		<-w.jobContext().Done()
+	}
+	for i := range watches {
+		<-watches[i].done
+	}
+}
 
-	waitGroup := sync.WaitGroup{}
-	waitGroup.Add(len(clusterInfos))
-	go func() {
-		// 遍历需要监听的列表
-		for i := range w.resources {
-			resource := w.resources[i]
-			for i := range clusterInfos {
-				co := controller.New(resource.Reconciler, controller.Options{})
-				c := cluster.New(clusterInfos[i].GetClusterName(), GetCfgByClusterInfo(clusterInfos[i]), cluster.Options{})
-				if resource.Scheme != nil {
-					c.SetScheme(resource.Scheme)
-				}
-				var err error
-				if resource.Owner != nil {
-					kinds, _, _ := c.GetScheme().ObjectKinds(resource.ObjectType)
-					if err = co.WatchResourceReconcileOwner(w.getCtxForClusterName(c.GetClusterName()), c, kinds[0], resource.Owner.ObjectType, resource.Owner.WatchOptions); err != nil {
-						for i := range w.failedHooks {
-							w.failedHooks[i](c.GetClusterName(), err)
-						}
-						waitGroup.Done()
-						continue
-					}
-				}
-				if err == nil {
-					if err = co.WatchResourceReconcileObject(w.getCtxForClusterName(c.GetClusterName()), c, resource.ObjectType, resource.WatchOptions); err != nil {
-						for i := range w.failedHooks {
-							w.failedHooks[i](c.GetClusterName(), err)
-						}
-						waitGroup.Done()
-						continue
+// watchCluster watches the resources selected by the given cluster's labels,
+// until the cluster's context is cancelled.
+func (w *WatchJob) watchCluster(cw *clusterWatch, info ClusterInfoInterface) {
+	defer cw.cancel()
+	name := info.GetClusterName()
+	w.notify(ClusterLifecycleListener.OnClusterStarting, ClusterLifecycleEvent{Cluster: name, Time: cw.startedAt})
+	defer func() {
+		w.notify(ClusterLifecycleListener.OnClusterStopped, ClusterLifecycleEvent{Cluster: name, Duration: time.Since(cw.startedAt)})
+	}()
+
+	cfg, err := GetCfgByClusterInfo(info)
+	if err != nil {
+		w.watchFailed(name, nil, configError{err: err}, 0)
+		return
+	}
+	health, err := NewHealthMonitor(name, cfg, w.health)
+	if err != nil {
+		w.watchFailed(name, nil, configError{err: err}, 0)
+		return
+	}
+	health.OnTransition(func(_ string, t StateTransition) {
+		w.onHealthTransition(cw, t)
+	})
+	cw.mu.Lock()
+	cw.cfg = cfg
+	cw.health = health
+	cw.stateSince = cw.startedAt
+	cw.mu.Unlock()
+
+	w.setClusterState(cw, health.Health().State)
+	defer w.forgetClusterState(cw)
+	go health.Run(cw.ctx)
+	w.syncClusterResources(cw, info)
+	<-cw.ctx.Done()
+	// syncClusterResources no longer starts resources once the context is done,
+	// so no goroutine is added to the wait group after this point.
+	cw.mu.Lock()
+	cw.mu.Unlock()
+	cw.wg.Wait()
+}
+
+// syncClusterResources starts watching the resources whose ClusterSelector matches the labels of info,
+// and stops watching the others.
+func (w *WatchJob) syncClusterResources(cw *clusterWatch, info ClusterInfoInterface) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.info = info
+	if cw.cfg == nil || cw.ctx.Err() != nil {
+		return
+	}
+
+	clusterLabels := labels.Set(info.GetLabels())
+	// 遍历需要监听的列表
+	for i := range w.resources {
+		resource := w.resources[i]
+		rw, running := cw.resources[resource]
+		selected := resource.ClusterSelector == nil || resource.ClusterSelector.Matches(clusterLabels)
+		if selected && !running {
+			ctx, cancel := context.WithCancel(cw.ctx)
+			rw := &resourceWatch{
+				cluster:  cw.name,
+				resource: resource,
+				cfg:      cw.cfg,
+				health:   cw.health,
+				cancel:   cancel,
+				abandon: func(keys []reconcile.Key) {
+					// only report the Requests abandoned because the cluster is stopped
+					if cw.ctx.Err() != nil && len(keys) > 0 {
+						cw.mu.Lock()
+						cw.abandoned = append(cw.abandoned, keys...)
+						cw.mu.Unlock()
 					}
-				}
-				w.getMgrByClusterName(c.GetClusterName()).AddController(co)
+				},
+
+				controllerOptions: controllerOptions(resource, info),
+				cacheOptions:      cacheOptions(resource, info),
 			}
-		}
-		w.mgrs.Range(func(key interface{}, value interface{}) (shouldContinue bool) {
+			cw.resources[resource] = rw
+			cw.wg.Add(1)
 			go func() {
-				if err := value.(*manager.Manager).Start(w.getCtxForClusterName(key.(string))); err != nil {
-					klog.Errorf("start controller failed, err :%s", err.Error())
-					for i := range w.failedHooks {
-						w.failedHooks[i](key.(string), err)
-					}
-				}
-				waitGroup.Done()
+				defer cw.wg.Done()
+				w.superviseClusterResource(ctx, rw)
 			}()
-			return true
-		})
+		} else if !selected && running {
+			rw.cancel()
+			delete(cw.resources, resource)
+		}
+	}
+}
+
+// watchClusterResource creates a cluster.Cluster and a controller for the resource of rw in its cluster,
+// and runs them with a new manager until ctx is cancelled or the manager fails.
+// Everything it created is torn down when it returns.
+func (w *WatchJob) watchClusterResource(ctx context.Context, rw *resourceWatch) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	started := time.Now()
+	name, resource, health := rw.cluster, rw.resource, rw.health
+
+	var co *controller.Controller
+	var depth func() int
+	shared := w.sharedWorkers > 0
+	if shared {
+		sc := w.getSharedController(resource)
+		co = sc.co
+		depth = func() int { return sc.queue.ClusterLen(name) }
+		sc.addWatch(rw)
+		defer sc.removeWatch(rw)
+		if n := rw.controllerOptions.MaxConcurrentReconciles; n > 0 {
+			// an override, so a restarted cluster and WithClusterFairness keep their own caps
+			defer sc.queue.OverrideMaxConcurrency(name, n)()
+		}
+	} else {
+		co = w.newController(resource, rw.controllerOptions, func(string) *resourceWatch { return rw })
+		depth = co.Queue.Len
+	}
+	stopped := rw.started(depth)
+	defer func() {
+		stopped(err)
+	}()
+	c := cluster.New(name, rw.cfg, cluster.Options{CacheOptions: rw.cacheOptions})
+	if resource.Scheme != nil {
+		c.SetScheme(resource.Scheme)
+	}
+	if shared {
+		// the shared controller is already running, the Requests of the cluster are held until its cache is synced
+		co.HoldCluster(c)
+		defer func() {
+			// cancel first, so the grace period of the running reconciles starts
+			cancel()
+			rw.abandon(co.DrainCluster(c))
+		}()
+	}
+	if err := watchResource(ctx, co, c, resource); err != nil {
+		return err
+	}
+	if synced, err := informersSynced(ctx, c, resource); err == nil {
+		rw.setSynced(synced)
+	}
+	health.CacheStarted(resource)
+	defer health.CacheStopped(resource)
+	go func() {
+		if c.WaitForCacheSync(ctx) {
+			if shared {
+				co.ReleaseHeldCluster(c)
+			}
+			metrics.CacheSyncDuration.WithLabelValues(name, resourceGVK(resource).Kind).Observe(time.Since(started).Seconds())
+			health.CacheSynced(resource)
+			w.notify(ClusterLifecycleListener.OnCacheSynced, ClusterLifecycleEvent{
+				Cluster:          name,
+				GroupVersionKind: resourceGVK(resource),
+				Duration:         time.Since(started),
+			})
+		}
 	}()
 
-	waitGroup.Wait()
+	mgr := manager.New()
+	mgr.SetElected(w.elected)
+	if shared {
+		// the shared controller is already running, only the cache of the cluster is started
+		mgr.AddCache(c)
+	} else {
+		mgr.AddController(co)
+	}
+	if err := mgr.Start(ctx); err != nil {
+		klog.FromContext(ctx).Error(err, "Start controller failed", "gvk", resourceGVK(resource))
+		return err
+	}
+	if !shared {
+		rw.abandon(co.TakeAbandoned(name))
+	}
+	return nil
+}
+
+// informersSynced returns a func reporting whether the informers of resource, of its owner if any,
+// and of its Watches, are synced.
+func informersSynced(ctx context.Context, c *cluster.Cluster, resource *WatchResource) (func() bool, error) {
+	ca, err := c.GetCache()
+	if err != nil {
+		return nil, err
+	}
+	objects := []client.Object{resource.ObjectType}
+	if resource.Owner != nil {
+		objects = append(objects, resource.Owner.ObjectType)
+	}
+	for i := range resource.Watches {
+		objects = append(objects, resource.Watches[i].ObjectType)
+	}
+	var synced []func() bool
+	for i := range objects {
+		informer, err := ca.GetInformer(ctx, objects[i])
+		if err != nil {
+			return nil, err
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+	return func() bool {
+		for i := range synced {
+			if !synced[i]() {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// watchResource configures co to watch resource, its owner if any, and its Watches, in cluster c.
+func watchResource(ctx context.Context, co *controller.Controller, c *cluster.Cluster, resource *WatchResource) error {
+	if resource.Owner != nil {
+		kinds, _, err := c.GetScheme().ObjectKinds(resource.ObjectType)
+		if err != nil {
+			return err
+		}
+		if len(kinds) == 0 {
+			return fmt.Errorf("no kind is registered for %T", resource.ObjectType)
+		}
+		if err := co.WatchResourceReconcileOwner(ctx, c, kinds[0], resource.Owner.ObjectType, resource.Owner.WatchOptions); err != nil {
+			return err
+		}
+	}
+	for i := range resource.Watches {
+		watch := &resource.Watches[i]
+		if err := co.WatchResourceReconcileMapFunc(ctx, c, watch.ObjectType, watch.MapFunc, watch.WatchOptions); err != nil {
+			return err
+		}
+	}
+	return co.WatchResourceReconcileObject(ctx, c, resource.ObjectType, resource.WatchOptions)
+}
+
+func (w *WatchJob) callFailedHooks(clusterName string, err error) {
+	for i := range w.failedHooks {
+		w.failedHooks[i](clusterName, err)
+	}
+}
+
+// sameConnection reports whether a and b reach the same cluster with the same credentials,
+// with the same options, i.e. whether they only differ by their labels.
+func sameConnection(a, b ClusterInfoInterface) bool {
+	return a.GetClusterName() == b.GetClusterName() &&
+		sameRestConfig(a.RestConfig(), b.RestConfig()) &&
+		a.GetApiServer() == b.GetApiServer() &&
+		a.GetToken() == b.GetToken() &&
+		bytes.Equal(a.GetCAData(), b.GetCAData()) &&
+		bytes.Equal(a.GetCertData(), b.GetCertData()) &&
+		bytes.Equal(a.GetKeyData(), b.GetKeyData()) &&
+		a.GetTLSServerName() == b.GetTLSServerName() &&
+		a.GetProxyURL() == b.GetProxyURL() &&
+		reflect.DeepEqual(a.GetImpersonate(), b.GetImpersonate()) &&
+		a.IsInsecure() == b.IsInsecure() &&
+		sameIdentity(a.GetCredentialSource(), b.GetCredentialSource()) &&
+		reflect.DeepEqual(a.GetExecProvider(), b.GetExecProvider()) &&
+		sameControllerOptions(a.GetControllerOptions(), b.GetControllerOptions()) &&
+		reflect.DeepEqual(a.GetCacheOptions(), b.GetCacheOptions())
+}
+
+// sameRestConfig reports whether a and b are the same config. Their funcs, such as WrapTransport or Proxy,
+// cannot be compared, so a config with funcs is only the same as itself. Their interfaces, such as Transport,
+// must be the same pointers.
+func sameRestConfig(a, b *rest.Config) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	if !sameIdentity(a.WrapTransport, b.WrapTransport) ||
+		!sameIdentity(a.Dial, b.Dial) ||
+		!sameIdentity(a.Proxy, b.Proxy) ||
+		!sameIdentity(a.Transport, b.Transport) ||
+		!sameIdentity(a.RateLimiter, b.RateLimiter) ||
+		!sameIdentity(a.WarningHandler, b.WarningHandler) ||
+		!sameIdentity(a.AuthConfigPersister, b.AuthConfigPersister) {
+		return false
+	}
+	ac, bc := rest.CopyConfig(a), rest.CopyConfig(b)
+	for _, c := range []*rest.Config{ac, bc} {
+		c.WrapTransport, c.Dial, c.Proxy = nil, nil, nil
+		c.Transport, c.RateLimiter, c.WarningHandler, c.AuthConfigPersister = nil, nil, nil, nil
+	}
+	return reflect.DeepEqual(ac, bc)
+}
+
+// sameControllerOptions reports whether a and b are the same options.
+// Their queue, rate limiter and the sink of their logger must be the same.
+func sameControllerOptions(a, b controller.Options) bool {
+	return a.JitterPeriod == b.JitterPeriod &&
+		a.MaxConcurrentReconciles == b.MaxConcurrentReconciles &&
+		sameIdentity(a.Queue, b.Queue) &&
+		sameIdentity(a.RateLimiter, b.RateLimiter) &&
+		sameIdentity(a.Logger.GetSink(), b.Logger.GetSink()) &&
+		a.ReconcileTimeout == b.ReconcileTimeout &&
+		a.Kind == b.Kind &&
+		reflect.DeepEqual(a.RecoverPanic, b.RecoverPanic) &&
+		reflect.DeepEqual(a.QuarantinePolicy, b.QuarantinePolicy) &&
+		a.GracePeriod == b.GracePeriod
+}
+
+// sameIdentity reports whether a and b are the same value: both nil, the same pointer,
+// or equal strings, numbers or booleans. Funcs, maps, slices and structs cannot be compared safely,
+// so they are only the same if they are both nil or zero: a CredentialFunc or a transport wrapper
+// always restarts the cluster, while the same *TokenFileSource does not.
+func sameIdentity(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() {
+		return va.IsValid() == vb.IsValid()
+	}
+	if va.Type() != vb.Type() {
+		return false
+	}
+	switch va.Kind() {
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		return va.Pointer() == vb.Pointer()
+	case reflect.Func, reflect.Map, reflect.Slice:
+		return va.IsNil() && vb.IsNil()
+	case reflect.Struct, reflect.Array:
+		return va.IsZero() && vb.IsZero()
+	case reflect.String:
+		return va.String() == vb.String()
+	case reflect.Bool:
+		return va.Bool() == vb.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return va.Int() == vb.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return va.Uint() == vb.Uint()
+	case reflect.Float32, reflect.Float64:
+		return va.Float() == vb.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return va.Complex() == vb.Complex()
+	}
+	return false
 }
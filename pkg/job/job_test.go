@@ -0,0 +1,432 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/controller"
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+func TestSameConnection(t *testing.T) {
+	src := NewTokenFileSource("/var/run/secrets/token")
+	options := controller.Options{MaxConcurrentReconciles: 2, Logger: klog.Background()}
+	withSource := func(src CredentialSource, labels map[string]string) ClusterInfoInterface {
+		return NewClusterWithToken("a", "https://a.example.com", "", WithCredentialSource(src),
+			WithControllerOptions(options), WithLabels(labels))
+	}
+
+	base := withSource(src, map[string]string{"env": "dev"})
+	if !sameConnection(base, withSource(src, map[string]string{"env": "prod"})) {
+		t.Error("clusters only differing by their labels must have the same connection")
+	}
+	if sameConnection(base, withSource(NewTokenFileSource("/var/run/secrets/token"), nil)) {
+		t.Error("clusters with different credential sources must not have the same connection")
+	}
+	credentialFunc := CredentialFunc(func() (string, time.Time, error) {
+		return "token", time.Time{}, nil
+	})
+	if sameConnection(withSource(credentialFunc, nil), withSource(credentialFunc, nil)) {
+		t.Error("funcs cannot be compared, clusters with a credential func must not have the same connection")
+	}
+
+	cfg := &rest.Config{Host: "https://a.example.com", WrapTransport: func(rt http.RoundTripper) http.RoundTripper { return rt }}
+	withCfg := NewClusterWithCfg("a", cfg, WithLabels(map[string]string{"env": "dev"}))
+	if !sameConnection(withCfg, NewClusterWithCfg("a", cfg)) {
+		t.Error("clusters with the same config must have the same connection")
+	}
+	if sameConnection(withCfg, NewClusterWithCfg("a", rest.CopyConfig(cfg))) {
+		t.Error("funcs cannot be compared, clusters with a copy of a config with funcs must not have the same connection")
+	}
+	plain := &rest.Config{Host: "https://a.example.com", Transport: http.DefaultTransport}
+	copied := rest.CopyConfig(plain)
+	if !sameConnection(NewClusterWithCfg("a", plain), NewClusterWithCfg("a", copied)) {
+		t.Error("clusters with a copy of the same config without funcs must have the same connection")
+	}
+	copied.Host = "https://b.example.com"
+	if sameConnection(NewClusterWithCfg("a", plain), NewClusterWithCfg("a", copied)) {
+		t.Error("clusters with different hosts must not have the same connection")
+	}
+	copied = rest.CopyConfig(plain)
+	copied.Transport = &http.Transport{}
+	if sameConnection(NewClusterWithCfg("a", plain), NewClusterWithCfg("a", copied)) {
+		t.Error("clusters with different transports must not have the same connection")
+	}
+}
+
+// lifecycleRecorder counts the clusters started and stopped by a job.
+type lifecycleRecorder struct {
+	mu       sync.Mutex
+	starting map[string]int
+	stopped  map[string]int
+}
+
+func newLifecycleRecorder() *lifecycleRecorder {
+	return &lifecycleRecorder{starting: map[string]int{}, stopped: map[string]int{}}
+}
+
+func (r *lifecycleRecorder) listener() ClusterLifecycleListener {
+	return ClusterLifecycleFuncs{
+		ClusterStartingFunc: func(e ClusterLifecycleEvent) {
+			r.mu.Lock()
+			r.starting[e.Cluster]++
+			r.mu.Unlock()
+		},
+		ClusterStoppedFunc: func(e ClusterLifecycleEvent) {
+			r.mu.Lock()
+			r.stopped[e.Cluster]++
+			r.mu.Unlock()
+		},
+	}
+}
+
+// balanced reports an error for every cluster started more or less times than it was stopped.
+func (r *lifecycleRecorder) balanced(t *testing.T) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, n := range r.starting {
+		if r.stopped[name] != n {
+			t.Errorf("cluster %s started %d times, stopped %d times", name, n, r.stopped[name])
+		}
+	}
+}
+
+// newLifecycleTestJob creates a job whose clusters are healthy, without any selected resource,
+// so that clusters can be started and stopped without an apiserver serving resources.
+func newLifecycleTestJob(t *testing.T) (*WatchJob, *lifecycleRecorder, func(name string) ClusterInfoInterface) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	w, err := NewWatchJob([]*WatchResource{{
+		ObjectType: &corev1.Pod{},
+		ContextReconciler: reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+			return reconcile.Result{}, nil
+		}),
+		ClusterSelector: labels.Nothing(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := newLifecycleRecorder()
+	w.WithHealthCheck(HealthCheckOptions{Interval: 10 * time.Millisecond}).AddLifecycleListener(recorder.listener())
+	return w, recorder, func(name string) ClusterInfoInterface {
+		return NewClusterWithCfg(name, &rest.Config{Host: srv.URL})
+	}
+}
+
+// waitFor fails the test if done is not closed in time.
+func waitFor(t *testing.T, what string, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestWatchJobLifecycle(t *testing.T) {
+	w, recorder, newCluster := newLifecycleTestJob(t)
+
+	// stopping clusters before anything started is a no-op
+	w.StopResourceWatch(newCluster("a"))
+	if abandoned := w.StopResourceWatchAndDrain(newCluster("a")); len(abandoned) != 0 {
+		t.Errorf("abandoned %v", abandoned)
+	}
+
+	if err := w.AddResourceWatch(newCluster("a"), newCluster("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.ListClusters(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("clusters = %v", got)
+	}
+	// adding a watched cluster again does not restart it
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	w.StopResourceWatchAndDrain(newCluster("a"))
+	if got := w.ListClusters(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("clusters = %v", got)
+	}
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// StartResourceWatch blocks until its clusters are stopped
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		w.StartResourceWatch(newCluster("c"))
+	}()
+	for len(w.ListClusters()) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	w.StopResourceWatch(newCluster("c"))
+	waitFor(t, "StartResourceWatch to return", started)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.StopWatchAndDrain()
+		w.Wait()
+	}()
+	waitFor(t, "the job to stop", stopped)
+
+	if err := w.AddResourceWatch(newCluster("d")); err != ErrJobStopped {
+		t.Errorf("AddResourceWatch after StopWatch = %v, want ErrJobStopped", err)
+	}
+	if err := w.UpdateResourceWatch(newCluster("d")); err != ErrJobStopped {
+		t.Errorf("UpdateResourceWatch after StopWatch = %v, want ErrJobStopped", err)
+	}
+	if got := w.ListClusters(); len(got) != 0 {
+		t.Errorf("clusters after StopWatch = %v", got)
+	}
+	recorder.mu.Lock()
+	if recorder.starting["a"] != 2 || recorder.starting["b"] != 1 || recorder.starting["c"] != 1 {
+		t.Errorf("starts = %v", recorder.starting)
+	}
+	recorder.mu.Unlock()
+	recorder.balanced(t)
+}
+
+func TestWatchJobLifecycleAnyOrder(t *testing.T) {
+	w, recorder, newCluster := newLifecycleTestJob(t)
+	names := []string{"a", "b", "c", "d"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < 50; j++ {
+				info := newCluster(names[r.Intn(len(names))])
+				switch r.Intn(5) {
+				case 0:
+					_ = w.AddResourceWatch(info)
+				case 1:
+					_ = w.UpdateResourceWatch(info)
+				case 2:
+					w.StopResourceWatch(info)
+				case 3:
+					w.StopResourceWatchAndDrain(info)
+				case 4:
+					go w.StartResourceWatch(info)
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.StopWatchAndDrain()
+		w.Wait()
+	}()
+	waitFor(t, "the job to stop", stopped)
+	if got := w.ListClusters(); len(got) != 0 {
+		t.Errorf("clusters after StopWatch = %v", got)
+	}
+	recorder.balanced(t)
+}
+
+// podAPIServer is a fake apiserver serving the discovery of the core group and the pods of the default
+// namespace, enough for the caches of the clusters to sync. It fails every request while down is set.
+type podAPIServer struct {
+	*httptest.Server
+	down int32
+	// delay is how long each failed request takes, in nanoseconds.
+	delay int64
+
+	mu       sync.Mutex
+	pods     []corev1.Pod
+	watchers map[chan corev1.Pod]struct{}
+	stop     chan struct{}
+}
+
+func newPodAPIServer(t *testing.T, pods ...string) *podAPIServer {
+	t.Helper()
+	s := &podAPIServer{watchers: map[chan corev1.Pod]struct{}{}, stop: make(chan struct{})}
+	for _, name := range pods {
+		s.pods = append(s.pods, newPod(name, len(s.pods)+1))
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(func() {
+		// end the watches, the server waits for them to close
+		close(s.stop)
+		s.Close()
+	})
+	return s
+}
+
+func newPod(name string, resourceVersion int) corev1.Pod {
+	return corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, ResourceVersion: strconv.Itoa(resourceVersion)},
+	}
+}
+
+func (s *podAPIServer) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&s.down, v)
+}
+
+func (s *podAPIServer) isDown() bool {
+	return atomic.LoadInt32(&s.down) == 1
+}
+
+// addPod adds a pod, and sends it to the running watches.
+func (s *podAPIServer) addPod(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pod := newPod(name, len(s.pods)+1)
+	s.pods = append(s.pods, pod)
+	for ch := range s.watchers {
+		select {
+		case ch <- pod:
+		default:
+		}
+	}
+}
+
+func (s *podAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	if s.isDown() {
+		time.Sleep(time.Duration(atomic.LoadInt64(&s.delay)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/readyz":
+		_, _ = w.Write([]byte("ok"))
+	case "/api":
+		_, _ = w.Write([]byte(`{"kind":"APIVersions","versions":["v1"],"serverAddressByClientCIDRs":[{"clientCIDR":"0.0.0.0/0","serverAddress":"127.0.0.1"}]}`))
+	case "/apis":
+		_, _ = w.Write([]byte(`{"kind":"APIGroupList","apiVersion":"v1","groups":[]}`))
+	case "/api/v1":
+		_, _ = w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[` +
+			`{"name":"pods","singularName":"","namespaced":true,"kind":"Pod","verbs":["get","list","watch"]}]}`))
+	case "/api/v1/pods", "/api/v1/namespaces/default/pods":
+		if r.URL.Query().Get("watch") == "true" {
+			s.watch(w, r)
+			return
+		}
+		s.mu.Lock()
+		list := corev1.PodList{
+			TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+			ListMeta: metav1.ListMeta{ResourceVersion: strconv.Itoa(len(s.pods))},
+			Items:    append([]corev1.Pod(nil), s.pods...),
+		}
+		s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(list)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// watch streams the added pods until the client, the server or the apiserver goes away.
+func (s *podAPIServer) watch(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan corev1.Pod, 10)
+	s.mu.Lock()
+	s.watchers[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, ch)
+		s.mu.Unlock()
+	}()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.isDown() {
+				return
+			}
+		case pod := <-ch:
+			raw, _ := json.Marshal(pod)
+			_ = json.NewEncoder(w).Encode(metav1.WatchEvent{Type: string(watch.Added), Object: runtime.RawExtension{Raw: raw}})
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// newPodTestJob creates a job watching the pods of every cluster with r, and a func creating clusters
+// of srv. The job is stopped when the test ends.
+func newPodTestJob(t *testing.T, srv *podAPIServer, r reconcile.ContextReconciler) (*WatchJob, func(name string) ClusterInfoInterface) {
+	t.Helper()
+	w, err := NewWatchJob([]*WatchResource{{ObjectType: &corev1.Pod{}, ContextReconciler: r}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WithHealthCheck(HealthCheckOptions{Interval: 10 * time.Millisecond})
+	t.Cleanup(func() {
+		w.StopWatchAndDrain()
+	})
+	return w, func(name string) ClusterInfoInterface {
+		return NewClusterWithCfg(name, &rest.Config{Host: srv.URL})
+	}
+}
+
+// reconcileRecorder records the Requests a job reconciles.
+type reconcileRecorder struct {
+	mu         sync.Mutex
+	reconciled []reconcile.Key
+}
+
+func (r *reconcileRecorder) Reconcile(_ context.Context, req reconcile.Request) (reconcile.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconciled = append(r.reconciled, req.Key)
+	return reconcile.Result{}, nil
+}
+
+// reconciledPod reports whether the pod of the cluster was reconciled.
+func (r *reconcileRecorder) reconciledPod(cluster, name string) func() bool {
+	return func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, key := range r.reconciled {
+			if key.ClusterName == cluster && key.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (r *reconcileRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.reconciled)
+}
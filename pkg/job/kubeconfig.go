@@ -0,0 +1,49 @@
+package job
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// NewClustersFromKubeconfig loads the given kubeconfig files, merged the same way kubectl merges a KUBECONFIG list,
+// and returns one cluster per context, named after the context.
+// If no path is given, the KUBECONFIG environment variable and then ~/.kube/config are used.
+// Each cluster keeps its context's own server, CA data, client certificates, token and exec plugin.
+func NewClustersFromKubeconfig(paths ...string) ([]ClusterInfoInterface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	switch len(paths) {
+	case 0:
+	case 1:
+		// an explicit path must exist
+		rules.ExplicitPath = paths[0]
+	default:
+		rules.Precedence = paths
+	}
+	raw, err := rules.Load()
+	if err != nil {
+		return nil, err
+	}
+	return clustersFromRawConfig(raw, rules)
+}
+
+// clustersFromRawConfig builds one cluster per context of raw, in context name order.
+func clustersFromRawConfig(raw *clientcmdapi.Config, configAccess clientcmd.ConfigAccess) ([]ClusterInfoInterface, error) {
+	names := make([]string, 0, len(raw.Contexts))
+	for name := range raw.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clusters := make([]ClusterInfoInterface, 0, len(names))
+	for _, name := range names {
+		cfg, err := clientcmd.NewNonInteractiveClientConfig(*raw, name, &clientcmd.ConfigOverrides{}, configAccess).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig context %s: %w", name, err)
+		}
+		clusters = append(clusters, NewClusterWithCfg(name, cfg))
+	}
+	return clusters, nil
+}
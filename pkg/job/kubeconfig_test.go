@@ -0,0 +1,279 @@
+package job
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+// kubeconfigFixtures are written next to each other, so relative paths resolve against the same directory.
+// Their cluster and user names are unique, so that any of them can be merged.
+var kubeconfigFixtures = map[string]string{
+	"token.yaml": `apiVersion: v1
+kind: Config
+clusters:
+- name: token
+  cluster:
+    server: https://token.example.com
+    certificate-authority-data: Y2E=
+users:
+- name: token
+  user:
+    token: secret
+contexts:
+- name: token
+  context: {cluster: token, user: token}
+current-context: token
+`,
+	"certs.yaml": `apiVersion: v1
+kind: Config
+clusters:
+- name: data
+  cluster:
+    server: https://data.example.com
+    tls-server-name: api.internal
+- name: files
+  cluster:
+    server: https://files.example.com
+    certificate-authority: certs/ca.crt
+users:
+- name: data
+  user:
+    client-certificate-data: Y2VydA==
+    client-key-data: a2V5
+- name: files
+  user:
+    client-certificate: certs/client.crt
+    client-key: certs/client.key
+contexts:
+- name: cert-data
+  context: {cluster: data, user: data}
+- name: cert-files
+  context: {cluster: files, user: files}
+current-context: cert-files
+`,
+	"exec.yaml": `apiVersion: v1
+kind: Config
+clusters:
+- name: exec
+  cluster:
+    server: https://exec.example.com
+    insecure-skip-tls-verify: true
+users:
+- name: exec
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: get-token
+      args: [--cluster, exec]
+      env:
+      - {name: REGION, value: eu}
+contexts:
+- name: exec
+  context: {cluster: exec, user: exec}
+current-context: exec
+`,
+	"override.yaml": `apiVersion: v1
+kind: Config
+clusters:
+- name: other
+  cluster:
+    server: https://override.example.com
+users:
+- name: other
+  user:
+    token: override
+contexts:
+- name: override
+  context: {cluster: other, user: other}
+`,
+	"dangling.yaml": `apiVersion: v1
+kind: Config
+users:
+- name: u
+  user:
+    token: secret
+contexts:
+- name: dangling
+  context: {cluster: missing, user: u}
+`,
+}
+
+// writeKubeconfigFixtures writes the fixtures and the certificates they refer to, and returns their directory.
+func writeKubeconfigFixtures(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ca.crt", "client.crt", "client.key"} {
+		if err := os.WriteFile(filepath.Join(dir, "certs", name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range kubeconfigFixtures {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestNewClustersFromKubeconfig(t *testing.T) {
+	dir := writeKubeconfigFixtures(t)
+	certs := filepath.Join(dir, "certs")
+
+	tests := []struct {
+		name  string
+		files []string
+		// want is the expected cluster names in order, check checks the rest.Config of some of them
+		want  []string
+		check map[string]func(t *testing.T, cfg *rest.Config)
+		err   string
+	}{
+		{
+			name:  "token and CA data",
+			files: []string{"token.yaml"},
+			want:  []string{"token"},
+			check: map[string]func(t *testing.T, cfg *rest.Config){
+				"token": func(t *testing.T, cfg *rest.Config) {
+					if cfg.Host != "https://token.example.com" || cfg.BearerToken != "secret" {
+						t.Errorf("host %s with token %q", cfg.Host, cfg.BearerToken)
+					}
+					if string(cfg.CAData) != "ca" {
+						t.Errorf("CA data = %q, want ca", cfg.CAData)
+					}
+				},
+			},
+		},
+		{
+			name:  "client certificates, every context regardless of the current one",
+			files: []string{"certs.yaml"},
+			want:  []string{"cert-data", "cert-files"},
+			check: map[string]func(t *testing.T, cfg *rest.Config){
+				"cert-data": func(t *testing.T, cfg *rest.Config) {
+					if string(cfg.CertData) != "cert" || string(cfg.KeyData) != "key" {
+						t.Errorf("client certificate %q and key %q", cfg.CertData, cfg.KeyData)
+					}
+					if cfg.ServerName != "api.internal" {
+						t.Errorf("TLS server name = %s, want api.internal", cfg.ServerName)
+					}
+				},
+				"cert-files": func(t *testing.T, cfg *rest.Config) {
+					if cfg.Host != "https://files.example.com" {
+						t.Errorf("host = %s, want the cluster of the context", cfg.Host)
+					}
+					// relative paths resolve against the kubeconfig
+					if cfg.CAFile != filepath.Join(certs, "ca.crt") {
+						t.Errorf("CA file = %s", cfg.CAFile)
+					}
+					if cfg.CertFile != filepath.Join(certs, "client.crt") || cfg.KeyFile != filepath.Join(certs, "client.key") {
+						t.Errorf("client certificate %s and key %s", cfg.CertFile, cfg.KeyFile)
+					}
+				},
+			},
+		},
+		{
+			name:  "exec plugin",
+			files: []string{"exec.yaml"},
+			want:  []string{"exec"},
+			check: map[string]func(t *testing.T, cfg *rest.Config){
+				"exec": func(t *testing.T, cfg *rest.Config) {
+					exec := cfg.ExecProvider
+					if exec == nil {
+						t.Fatal("no exec provider")
+					}
+					if exec.Command != "get-token" || !reflect.DeepEqual(exec.Args, []string{"--cluster", "exec"}) {
+						t.Errorf("exec %s %v", exec.Command, exec.Args)
+					}
+					if len(exec.Env) != 1 || exec.Env[0].Name != "REGION" || exec.Env[0].Value != "eu" {
+						t.Errorf("exec env %v", exec.Env)
+					}
+					if !cfg.Insecure || cfg.BearerToken != "" {
+						t.Errorf("insecure %v with token %q", cfg.Insecure, cfg.BearerToken)
+					}
+				},
+			},
+		},
+		{
+			name:  "merged files",
+			files: []string{"token.yaml", "override.yaml", "exec.yaml"},
+			want:  []string{"exec", "override", "token"},
+			check: map[string]func(t *testing.T, cfg *rest.Config){
+				"token": func(t *testing.T, cfg *rest.Config) {
+					if cfg.Host != "https://token.example.com" || cfg.BearerToken != "secret" {
+						t.Errorf("host %s with token %q", cfg.Host, cfg.BearerToken)
+					}
+				},
+				"override": func(t *testing.T, cfg *rest.Config) {
+					if cfg.Host != "https://override.example.com" || cfg.BearerToken != "override" {
+						t.Errorf("host %s with token %q", cfg.Host, cfg.BearerToken)
+					}
+				},
+			},
+		},
+		{
+			name:  "context of a missing cluster",
+			files: []string{"dangling.yaml"},
+			err:   "kubeconfig context dangling",
+		},
+		{
+			name:  "missing explicit file",
+			files: []string{"missing.yaml"},
+			err:   "missing.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := make([]string, 0, len(tt.files))
+			for _, file := range tt.files {
+				paths = append(paths, filepath.Join(dir, file))
+			}
+			clusters, err := NewClustersFromKubeconfig(paths...)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want it to mention %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, cluster := range clusters {
+				names = append(names, cluster.GetClusterName())
+				if check := tt.check[cluster.GetClusterName()]; check != nil {
+					cfg, err := GetCfgByClusterInfo(cluster)
+					if err != nil {
+						t.Fatal(err)
+					}
+					check(t, cfg)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("clusters %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClustersFromKubeconfigEnv(t *testing.T) {
+	dir := writeKubeconfigFixtures(t)
+	t.Setenv("KUBECONFIG", filepath.Join(dir, "exec.yaml")+string(os.PathListSeparator)+filepath.Join(dir, "token.yaml"))
+
+	clusters, err := NewClustersFromKubeconfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, cluster := range clusters {
+		names = append(names, cluster.GetClusterName())
+	}
+	if want := []string{"exec", "token"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("clusters %v, want %v", names, want)
+	}
+}
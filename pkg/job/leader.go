@@ -0,0 +1,140 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// ErrLeadershipLost is the error the job is stopped with when it loses its leadership.
+var ErrLeadershipLost = errors.New("leader election lost")
+
+// LeaderElectionOptions configures the leader election of a WatchJob, with a Lease in a home cluster.
+// Every replica watches the clusters and keeps its caches warm, but only the leader runs the controllers.
+type LeaderElectionOptions struct {
+	// HomeCluster is the cluster holding the Lease. It is ignored if Client is set.
+	HomeCluster ClusterInfoInterface
+	// Client is the client of the Leases. It defaults to a client of HomeCluster.
+	Client coordinationv1client.LeasesGetter
+	// Namespace and Name are the namespace and name of the Lease.
+	Namespace string
+	Name      string
+	// Identity is the identity of the replica. Defaults to the hostname followed by a random suffix.
+	Identity string
+	// LeaseDuration is how long the standbys wait before taking over a Lease that is not renewed. Defaults to 15 seconds.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader retries renewing the Lease before giving up. Defaults to 10 seconds.
+	RenewDeadline time.Duration
+	// RetryPeriod is the period between two attempts to acquire or renew the Lease. Defaults to 2 seconds.
+	RetryPeriod time.Duration
+}
+
+func (o *LeaderElectionOptions) setDefaults() {
+	if o.Identity == "" {
+		hostname, _ := os.Hostname()
+		o.Identity = hostname + "_" + string(uuid.NewUUID())
+	}
+	if o.LeaseDuration <= 0 {
+		o.LeaseDuration = 15 * time.Second
+	}
+	if o.RenewDeadline <= 0 {
+		o.RenewDeadline = 10 * time.Second
+	}
+	if o.RetryPeriod <= 0 {
+		o.RetryPeriod = 2 * time.Second
+	}
+}
+
+// client returns the client of the Leases.
+func (o *LeaderElectionOptions) client() (coordinationv1client.LeasesGetter, error) {
+	if o.Client != nil {
+		return o.Client, nil
+	}
+	if o.HomeCluster == nil {
+		return nil, errors.New("leader election needs a home cluster or a client")
+	}
+	cfg, err := GetCfgByClusterInfo(o.HomeCluster)
+	if err != nil {
+		return nil, err
+	}
+	return coordinationv1client.NewForConfig(cfg)
+}
+
+// WithLeaderElection makes the replicas of the job elect a leader with a Lease.
+// The caches of every replica are started, but the controllers only start once the replica is elected.
+// The job is stopped if it loses its leadership, with ErrLeadershipLost reported to the failed hooks.
+// It must be called before the job starts watching clusters, and cannot be combined with WithSharding:
+// such a job is stopped as soon as it starts, with ErrShardingWithLeaderElection.
+func (w *WatchJob) WithLeaderElection(o LeaderElectionOptions) *WatchJob {
+	o.setDefaults()
+	w.leaderElection = &o
+	if w.sharding != nil {
+		w.err = ErrShardingWithLeaderElection
+	}
+	return w
+}
+
+// IsLeader reports whether the job is elected, or has no leader election, and is not stopped.
+func (w *WatchJob) IsLeader() bool {
+	ctx := w.jobContext()
+	select {
+	case <-w.elected:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
+
+// runLeaderElection campaigns for the Lease until ctx is done or the leadership is lost.
+func (w *WatchJob) runLeaderElection(ctx context.Context) {
+	o := w.leaderElection
+	logger := w.logger.WithValues("lease", o.Namespace+"/"+o.Name, "identity", o.Identity)
+	fail := func(err error) {
+		logger.Error(err, "Leader election failed, stop the job")
+		w.callFailedHooks("", err)
+		w.StopWatch()
+	}
+	client, err := o.client()
+	if err != nil {
+		fail(err)
+		return
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  v1.ObjectMeta{Namespace: o.Namespace, Name: o.Name},
+			Client:     client,
+			LockConfig: resourcelock.ResourceLockConfig{Identity: o.Identity},
+		},
+		LeaseDuration:   o.LeaseDuration,
+		RenewDeadline:   o.RenewDeadline,
+		RetryPeriod:     o.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            o.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				logger.Info("Elected, start the controllers")
+				close(w.elected)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() == nil {
+					fail(ErrLeadershipLost)
+				}
+			},
+			OnNewLeader: func(identity string) {
+				logger.Info("New leader elected", "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+	le.Run(ctx)
+}
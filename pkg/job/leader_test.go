@@ -0,0 +1,127 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// waitUntil fails the test if cond does not hold in time.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// newElectingTestJob creates a job reconciling the pods of srv, electing its leader with the Leases of client,
+// and starts it.
+func newElectingTestJob(t *testing.T, srv *podAPIServer, client coordinationv1client.LeasesGetter, identity string,
+	failedHooks ...func(clusterName string, err error)) (*WatchJob, *reconcileRecorder) {
+	t.Helper()
+	r := &reconcileRecorder{}
+	w, newCluster := newPodTestJob(t, srv, r)
+	w.AddFailedRollBack(failedHooks...).WithLeaderElection(LeaderElectionOptions{
+		Client:        client,
+		Namespace:     "default",
+		Name:          "mc-operator",
+		Identity:      identity,
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   50 * time.Millisecond,
+	})
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+	return w, r
+}
+
+// holder returns the holder of the Lease of the test jobs.
+func holder(t *testing.T, client coordinationv1client.LeasesGetter) string {
+	t.Helper()
+	lease, err := client.Leases("default").Get(context.Background(), "mc-operator", metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestLeaderElectionHandover(t *testing.T) {
+	srv := newPodAPIServer(t, "x")
+	client := fake.NewSimpleClientset().CoordinationV1()
+	first, reconciledByFirst := newElectingTestJob(t, srv, client, "first")
+	waitUntil(t, "the first replica to be elected", first.IsLeader)
+	waitUntil(t, "the leader to reconcile", reconciledByFirst.reconciledPod("a", "x"))
+
+	second, reconciledBySecond := newElectingTestJob(t, srv, client, "second")
+	srv.addPod("y")
+	waitUntil(t, "the leader to reconcile the added pod", reconciledByFirst.reconciledPod("a", "y"))
+	time.Sleep(200 * time.Millisecond)
+	if second.IsLeader() {
+		t.Fatal("the second replica must stand by while the first one renews the Lease")
+	}
+	if got := holder(t, client); got != "first" {
+		t.Fatalf("Lease held by %q", got)
+	}
+	if n := reconciledBySecond.count(); n != 0 {
+		t.Fatalf("the standby replica reconciled %d times", n)
+	}
+
+	// the first replica releases the Lease when it is stopped, the second one takes the reconciling over
+	first.StopWatchAndDrain()
+	if first.IsLeader() {
+		t.Error("a stopped replica is not the leader")
+	}
+	waitUntil(t, "the second replica to take over", second.IsLeader)
+	if got := holder(t, client); got != "second" {
+		t.Errorf("Lease held by %q after the handover", got)
+	}
+	n := reconciledByFirst.count()
+	waitUntil(t, "the new leader to reconcile", reconciledBySecond.reconciledPod("a", "x"))
+	srv.addPod("z")
+	waitUntil(t, "the new leader to reconcile the added pod", reconciledBySecond.reconciledPod("a", "z"))
+	if got := reconciledByFirst.count(); got != n {
+		t.Errorf("the stopped replica reconciled %d more times", got-n)
+	}
+}
+
+func TestLeaderElectionLost(t *testing.T) {
+	srv := newPodAPIServer(t, "x")
+	client := fake.NewSimpleClientset().CoordinationV1()
+	var mu sync.Mutex
+	var failures []error
+	w, _ := newElectingTestJob(t, srv, client, "first", func(_ string, err error) {
+		mu.Lock()
+		failures = append(failures, err)
+		mu.Unlock()
+	})
+	waitUntil(t, "the replica to be elected", w.IsLeader)
+
+	// another replica takes the Lease over, the leader can no longer renew it
+	lease, err := client.Leases("default").Get(context.Background(), "mc-operator", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "other"
+	lease.Spec.HolderIdentity = &other
+	if _, err := client.Leases("default").Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the job to stop", func() bool { return w.jobContext().Err() != nil })
+	if w.IsLeader() {
+		t.Error("a replica that lost the Lease is not the leader")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failures) != 1 || !errors.Is(failures[0], ErrLeadershipLost) {
+		t.Errorf("failures = %v, want ErrLeadershipLost", failures)
+	}
+}
@@ -0,0 +1,251 @@
+package job
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// ErrorCategory classifies the errors reported to ClusterLifecycleListeners.
+type ErrorCategory string
+
+const (
+	// ErrorCategoryNone is the category of events without error.
+	ErrorCategoryNone ErrorCategory = ""
+	// ErrorCategoryConnection is the category of network and TLS errors, and of unavailable apiservers.
+	ErrorCategoryConnection ErrorCategory = "Connection"
+	// ErrorCategoryTimeout is the category of timed out requests.
+	ErrorCategoryTimeout ErrorCategory = "Timeout"
+	// ErrorCategoryAuthentication is the category of requests rejected with 401 Unauthorized.
+	ErrorCategoryAuthentication ErrorCategory = "Authentication"
+	// ErrorCategoryAuthorization is the category of requests rejected with 403 Forbidden.
+	ErrorCategoryAuthorization ErrorCategory = "Authorization"
+	// ErrorCategoryResourceNotFound is the category of resources the cluster does not serve, e.g. a missing CRD.
+	ErrorCategoryResourceNotFound ErrorCategory = "ResourceNotFound"
+	// ErrorCategoryConfiguration is the category of invalid cluster or resource configurations.
+	ErrorCategoryConfiguration ErrorCategory = "Configuration"
+	// ErrorCategoryUnknown is the category of any other error.
+	ErrorCategoryUnknown ErrorCategory = "Unknown"
+)
+
+// configError marks the errors caused by an invalid configuration.
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string {
+	return e.err.Error()
+}
+
+func (e configError) Unwrap() error {
+	return e.err
+}
+
+// ClassifyError returns the category of err.
+func ClassifyError(err error) ErrorCategory {
+	if err == nil {
+		return ErrorCategoryNone
+	}
+	var ce configError
+	if errors.As(err, &ce) {
+		return ErrorCategoryConfiguration
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if meta.IsNoMatchError(e) {
+			return ErrorCategoryResourceNotFound
+		}
+		if runtime.IsNotRegisteredError(e) {
+			return ErrorCategoryConfiguration
+		}
+	}
+
+	switch {
+	case apierrors.IsUnauthorized(err):
+		return ErrorCategoryAuthentication
+	case apierrors.IsForbidden(err):
+		return ErrorCategoryAuthorization
+	case apierrors.IsNotFound(err):
+		return ErrorCategoryResourceNotFound
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err), errors.Is(err, context.DeadlineExceeded):
+		return ErrorCategoryTimeout
+	case apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err):
+		return ErrorCategoryConnection
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorCategoryTimeout
+		}
+		return ErrorCategoryConnection
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalidCert) {
+		return ErrorCategoryConnection
+	}
+	return ErrorCategoryUnknown
+}
+
+// ClusterLifecycleEvent is the payload of the ClusterLifecycleListener calls.
+type ClusterLifecycleEvent struct {
+	// Cluster is the name of the cluster.
+	Cluster string
+	// GroupVersionKind is the kind of the watched resource, for resource events.
+	GroupVersionKind schema.GroupVersionKind
+	// Err is the error that caused the event, if any.
+	Err error
+	// Category is the category of Err.
+	Category ErrorCategory
+	// Duration depends on the event:
+	// the time to sync for OnCacheSynced, how long the cluster had been healthy for OnClusterDegraded,
+	// how long it was degraded for OnClusterRecovered,
+	// how long it was watched for OnClusterStopped, and how long the watch ran for OnResourceWatchFailed.
+	Duration time.Duration
+	// Time is when the event happened.
+	Time time.Time
+}
+
+// ClusterLifecycleListener is notified of the lifecycle of the clusters of a WatchJob.
+type ClusterLifecycleListener interface {
+	// OnClusterStarting is called when the job starts watching a cluster.
+	OnClusterStarting(ClusterLifecycleEvent)
+	// OnCacheSynced is called when the cache of a resource is synced.
+	OnCacheSynced(ClusterLifecycleEvent)
+	// OnClusterDegraded is called once when a healthy cluster starts failing its health probes.
+	// It is not called again when the degraded cluster is then lost: use GetClusterHealth for its current state.
+	OnClusterDegraded(ClusterLifecycleEvent)
+	// OnClusterRecovered is called when a degraded cluster is healthy again.
+	OnClusterRecovered(ClusterLifecycleEvent)
+	// OnClusterStopped is called when the job no longer watches a cluster.
+	OnClusterStopped(ClusterLifecycleEvent)
+	// OnResourceWatchFailed is called when the watch of a resource, or of a whole cluster, fails.
+	OnResourceWatchFailed(ClusterLifecycleEvent)
+}
+
+// ClusterLifecycleFuncs is an adaptor to let you easily specify as many or
+// as few of the lifecycle functions as you want while still implementing
+// ClusterLifecycleListener.
+type ClusterLifecycleFuncs struct {
+	ClusterStartingFunc     func(ClusterLifecycleEvent)
+	CacheSyncedFunc         func(ClusterLifecycleEvent)
+	ClusterDegradedFunc     func(ClusterLifecycleEvent)
+	ClusterRecoveredFunc    func(ClusterLifecycleEvent)
+	ClusterStoppedFunc      func(ClusterLifecycleEvent)
+	ResourceWatchFailedFunc func(ClusterLifecycleEvent)
+}
+
+func (f ClusterLifecycleFuncs) OnClusterStarting(e ClusterLifecycleEvent) {
+	if f.ClusterStartingFunc != nil {
+		f.ClusterStartingFunc(e)
+	}
+}
+
+func (f ClusterLifecycleFuncs) OnCacheSynced(e ClusterLifecycleEvent) {
+	if f.CacheSyncedFunc != nil {
+		f.CacheSyncedFunc(e)
+	}
+}
+
+func (f ClusterLifecycleFuncs) OnClusterDegraded(e ClusterLifecycleEvent) {
+	if f.ClusterDegradedFunc != nil {
+		f.ClusterDegradedFunc(e)
+	}
+}
+
+func (f ClusterLifecycleFuncs) OnClusterRecovered(e ClusterLifecycleEvent) {
+	if f.ClusterRecoveredFunc != nil {
+		f.ClusterRecoveredFunc(e)
+	}
+}
+
+func (f ClusterLifecycleFuncs) OnClusterStopped(e ClusterLifecycleEvent) {
+	if f.ClusterStoppedFunc != nil {
+		f.ClusterStoppedFunc(e)
+	}
+}
+
+func (f ClusterLifecycleFuncs) OnResourceWatchFailed(e ClusterLifecycleEvent) {
+	if f.ResourceWatchFailedFunc != nil {
+		f.ResourceWatchFailedFunc(e)
+	}
+}
+
+// AddLifecycleListener registers listeners notified of the lifecycle of the job's clusters.
+// It must be called before the job starts watching clusters.
+func (w *WatchJob) AddLifecycleListener(l ...ClusterLifecycleListener) *WatchJob {
+	w.listeners = append(w.listeners, l...)
+	return w
+}
+
+// notify calls f for every listener with an event about cluster.
+func (w *WatchJob) notify(f func(ClusterLifecycleListener, ClusterLifecycleEvent), e ClusterLifecycleEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Err != nil && e.Category == ErrorCategoryNone {
+		e.Category = ClassifyError(e.Err)
+	}
+	for i := range w.listeners {
+		f(w.listeners[i], e)
+	}
+}
+
+// watchFailed reports an error of the watch of a resource, or of the whole cluster if resource is nil,
+// to the failed hooks and the listeners.
+func (w *WatchJob) watchFailed(name string, resource *WatchResource, err error, duration time.Duration) {
+	w.callFailedHooks(name, err)
+	e := ClusterLifecycleEvent{Cluster: name, Err: err, Duration: duration}
+	if resource != nil {
+		e.GroupVersionKind = resourceGVK(resource)
+	}
+	w.notify(ClusterLifecycleListener.OnResourceWatchFailed, e)
+}
+
+// onHealthTransition notifies the listeners when a cluster is degraded or recovers,
+// once per outage: the transition from Degraded to Lost is not notified.
+func (w *WatchJob) onHealthTransition(cw *clusterWatch, t StateTransition) {
+	degraded := func(s ClusterState) bool {
+		return s == ClusterStateDegraded || s == ClusterStateLost
+	}
+	cw.mu.Lock()
+	since := cw.stateSince
+	cw.stateSince = t.Time
+	if degraded(t.From) && degraded(t.To) {
+		// still degraded, keep counting from the first failure
+		cw.stateSince = since
+	}
+	cw.mu.Unlock()
+	w.setClusterState(cw, t.To)
+
+	e := ClusterLifecycleEvent{Cluster: cw.name, Err: t.Err, Time: t.Time, Duration: t.Time.Sub(since)}
+	switch {
+	case degraded(t.To) && !degraded(t.From):
+		w.notify(ClusterLifecycleListener.OnClusterDegraded, e)
+	case degraded(t.From) && !degraded(t.To):
+		w.notify(ClusterLifecycleListener.OnClusterRecovered, e)
+	}
+}
+
+// resourceGVK returns the GroupVersionKind of the watched resource, or an empty one if its type is not registered.
+func resourceGVK(resource *WatchResource) schema.GroupVersionKind {
+	s := resource.Scheme
+	if s == nil {
+		s = scheme.Scheme
+	}
+	gvk, err := apiutil.GVKForObject(resource.ObjectType, s)
+	if err != nil {
+		return schema.GroupVersionKind{}
+	}
+	return gvk
+}
@@ -0,0 +1,188 @@
+package job
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	widget := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	for _, tc := range []struct {
+		err  error
+		want ErrorCategory
+	}{
+		{nil, ErrorCategoryNone},
+		{configError{err: errors.New("no host")}, ErrorCategoryConfiguration},
+		{fmt.Errorf("start: %w", configError{err: errors.New("no host")}), ErrorCategoryConfiguration},
+		{runtime.NewNotRegisteredErrForKind("test", widget), ErrorCategoryConfiguration},
+		{fmt.Errorf("watch: %w", &meta.NoKindMatchError{GroupKind: widget.GroupKind()}), ErrorCategoryResourceNotFound},
+		{apierrors.NewNotFound(pods, "x"), ErrorCategoryResourceNotFound},
+		{apierrors.NewUnauthorized("expired"), ErrorCategoryAuthentication},
+		{apierrors.NewForbidden(pods, "x", errors.New("rbac")), ErrorCategoryAuthorization},
+		{apierrors.NewTimeoutError("slow", 1), ErrorCategoryTimeout},
+		{apierrors.NewServerTimeout(pods, "list", 1), ErrorCategoryTimeout},
+		{fmt.Errorf("probe: %w", context.DeadlineExceeded), ErrorCategoryTimeout},
+		{&url.Error{Op: "Get", URL: "https://a", Err: timeoutError{}}, ErrorCategoryTimeout},
+		{apierrors.NewServiceUnavailable("down"), ErrorCategoryConnection},
+		{apierrors.NewInternalError(errors.New("etcd")), ErrorCategoryConnection},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ErrorCategoryConnection},
+		{fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}), ErrorCategoryConnection},
+		{fmt.Errorf("tls: %w", x509.HostnameError{Host: "a"}), ErrorCategoryConnection},
+		{fmt.Errorf("tls: %w", x509.CertificateInvalidError{Reason: x509.Expired}), ErrorCategoryConnection},
+		{errors.New("other"), ErrorCategoryUnknown},
+	} {
+		if got := ClassifyError(tc.err); got != tc.want {
+			t.Errorf("ClassifyError(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// hookRecorder records the lifecycle events of a job, in order.
+type hookRecorder struct {
+	mu     sync.Mutex
+	hooks  []string
+	events []ClusterLifecycleEvent
+}
+
+func (r *hookRecorder) record(hook string) func(ClusterLifecycleEvent) {
+	return func(e ClusterLifecycleEvent) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.hooks = append(r.hooks, hook)
+		r.events = append(r.events, e)
+	}
+}
+
+func (r *hookRecorder) listener() ClusterLifecycleListener {
+	return ClusterLifecycleFuncs{
+		ClusterStartingFunc:     r.record("Starting"),
+		CacheSyncedFunc:         r.record("CacheSynced"),
+		ClusterDegradedFunc:     r.record("Degraded"),
+		ClusterRecoveredFunc:    r.record("Recovered"),
+		ClusterStoppedFunc:      r.record("Stopped"),
+		ResourceWatchFailedFunc: r.record("WatchFailed"),
+	}
+}
+
+// called returns the hooks called so far, and their events.
+func (r *hookRecorder) called() ([]string, []ClusterLifecycleEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.hooks...), append([]ClusterLifecycleEvent(nil), r.events...)
+}
+
+// calledHook reports whether hook was called.
+func (r *hookRecorder) calledHook(hook string) func() bool {
+	return func() bool {
+		hooks, _ := r.called()
+		for _, h := range hooks {
+			if h == hook {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// clusterState reports whether the cluster is in the given health state.
+func clusterState(w *WatchJob, cluster string, state ClusterState) func() bool {
+	return func() bool {
+		h, ok := w.GetClusterHealth(cluster)
+		return ok && h.State == state
+	}
+}
+
+func TestLifecycleHooksOfFlappingCluster(t *testing.T) {
+	srv := newPodAPIServer(t, "x")
+	r := &reconcileRecorder{}
+	w, newCluster := newPodTestJob(t, srv, r)
+	hooks := &hookRecorder{}
+	w.AddLifecycleListener(hooks.listener())
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the cache to sync", hooks.calledHook("CacheSynced"))
+	waitUntil(t, "the pod to be reconciled", r.reconciledPod("a", "x"))
+
+	// the outage is notified once, though the cluster is degraded, then lost
+	srv.setDown(true)
+	waitUntil(t, "the cluster to be lost", clusterState(w, "a", ClusterStateLost))
+	time.Sleep(50 * time.Millisecond)
+	srv.setDown(false)
+	waitUntil(t, "the cluster to recover", hooks.calledHook("Recovered"))
+	srv.addPod("y")
+	waitUntil(t, "the pod added after the outage to be reconciled", r.reconciledPod("a", "y"))
+
+	w.StopResourceWatchAndDrain(newCluster("a"))
+	got, events := hooks.called()
+	want := []string{"Starting", "CacheSynced", "Degraded", "Recovered", "Stopped"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("hooks called %v, want %v", got, want)
+	}
+	for i, e := range events {
+		if e.Cluster != "a" || e.Time.IsZero() {
+			t.Errorf("%s event of cluster %q at %s", got[i], e.Cluster, e.Time)
+		}
+	}
+	if synced := events[1]; synced.GroupVersionKind.Kind != "Pod" || synced.Duration <= 0 {
+		t.Errorf("cache synced event of %v after %s", synced.GroupVersionKind, synced.Duration)
+	}
+	if degraded := events[2]; degraded.Err == nil || degraded.Category != ErrorCategoryConnection || degraded.Duration <= 0 {
+		t.Errorf("degraded event with %q error %v, healthy for %s", degraded.Category, degraded.Err, degraded.Duration)
+	}
+	// the outage lasted through the lost state
+	if recovered := events[3]; recovered.Err != nil || recovered.Duration < 50*time.Millisecond {
+		t.Errorf("recovered event with error %v, degraded for %s", recovered.Err, recovered.Duration)
+	}
+}
+
+func TestLifecycleHooksOfFailedWatch(t *testing.T) {
+	srv := newPodAPIServer(t)
+	srv.setDown(true)
+	w, newCluster := newPodTestJob(t, srv, &reconcileRecorder{})
+	hooks := &hookRecorder{}
+	w.AddLifecycleListener(hooks.listener())
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the watch to fail", hooks.calledHook("WatchFailed"))
+
+	got, events := hooks.called()
+	if got[0] != "Starting" {
+		t.Errorf("hooks called %v, want the cluster started first", got)
+	}
+	var failed ClusterLifecycleEvent
+	for i := range got {
+		if got[i] == "WatchFailed" {
+			failed = events[i]
+		}
+	}
+	if failed.GroupVersionKind != corev1.SchemeGroupVersion.WithKind("Pod") || failed.Err == nil {
+		t.Errorf("watch of %v failed with %v", failed.GroupVersionKind, failed.Err)
+	}
+	// the apiserver answers 503 Service Unavailable
+	if failed.Category != ErrorCategoryConnection {
+		t.Errorf("watch failure classified %q, want %q: %v", failed.Category, ErrorCategoryConnection, failed.Err)
+	}
+}
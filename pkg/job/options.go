@@ -0,0 +1,62 @@
+package job
+
+import (
+	"github.com/wangguoyan/mc-operator/pkg/cluster"
+	"github.com/wangguoyan/mc-operator/pkg/controller"
+)
+
+// controllerOptions returns the options of the controller of resource in a cluster:
+// the options of the cluster are merged over those of the resource.
+func controllerOptions(resource *WatchResource, info ClusterInfoInterface) controller.Options {
+	o := resource.ControllerOptions
+	o.Queue = nil
+	if resource.ReconcileTimeout > 0 {
+		o.ReconcileTimeout = resource.ReconcileTimeout
+	}
+	if info == nil {
+		return o
+	}
+	override := info.GetControllerOptions()
+	if override.JitterPeriod > 0 {
+		o.JitterPeriod = override.JitterPeriod
+	}
+	if override.MaxConcurrentReconciles > 0 {
+		o.MaxConcurrentReconciles = override.MaxConcurrentReconciles
+	}
+	if override.RateLimiter != nil {
+		o.RateLimiter = override.RateLimiter
+	}
+	if override.Logger.GetSink() != nil {
+		o.Logger = override.Logger
+	}
+	if override.ReconcileTimeout > 0 {
+		o.ReconcileTimeout = override.ReconcileTimeout
+	}
+	if override.RecoverPanic != nil {
+		o.RecoverPanic = override.RecoverPanic
+	}
+	if override.QuarantinePolicy != nil {
+		o.QuarantinePolicy = override.QuarantinePolicy
+	}
+	if override.GracePeriod != 0 {
+		o.GracePeriod = override.GracePeriod
+	}
+	return o
+}
+
+// cacheOptions returns the options of the cache of resource in a cluster:
+// the options of the cluster are merged over those of the resource.
+func cacheOptions(resource *WatchResource, info ClusterInfoInterface) cluster.CacheOptions {
+	o := resource.CacheOptions
+	if info == nil {
+		return o
+	}
+	override := info.GetCacheOptions()
+	if override.Resync != nil {
+		o.Resync = override.Resync
+	}
+	if override.Namespace != "" {
+		o.Namespace = override.Namespace
+	}
+	return o
+}
@@ -0,0 +1,39 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/controller"
+	"k8s.io/client-go/rest"
+)
+
+func TestControllerOptionsReconcileTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		controller time.Duration
+		resource   time.Duration
+		cluster    time.Duration
+		want       time.Duration
+	}{
+		{name: "unset"},
+		{name: "controller options", controller: time.Second, want: time.Second},
+		{name: "resource over controller options", controller: time.Second, resource: 2 * time.Second, want: 2 * time.Second},
+		{name: "resource only", resource: 2 * time.Second, want: 2 * time.Second},
+		{name: "cluster over resource", controller: time.Second, resource: 2 * time.Second, cluster: 3 * time.Second, want: 3 * time.Second},
+		{name: "cluster over controller options", controller: time.Second, cluster: 3 * time.Second, want: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := &WatchResource{
+				ReconcileTimeout:  tt.resource,
+				ControllerOptions: controller.Options{ReconcileTimeout: tt.controller},
+			}
+			info := NewClusterWithCfg("a", &rest.Config{},
+				WithControllerOptions(controller.Options{ReconcileTimeout: tt.cluster}))
+			if got := controllerOptions(resource, info).ReconcileTimeout; got != tt.want {
+				t.Errorf("ReconcileTimeout = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
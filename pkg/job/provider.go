@@ -0,0 +1,61 @@
+package job
+
+import (
+	"context"
+)
+
+// ClusterEventType describes how a ClusterProvider's view of a cluster changed.
+type ClusterEventType string
+
+const (
+	// ClusterAdded is sent when a cluster becomes known to the provider.
+	ClusterAdded ClusterEventType = "Added"
+	// ClusterUpdated is sent when a known cluster's connection info changed.
+	ClusterUpdated ClusterEventType = "Updated"
+	// ClusterRemoved is sent when a cluster is no longer known to the provider.
+	ClusterRemoved ClusterEventType = "Removed"
+)
+
+// ClusterEvent is emitted by a ClusterProvider for every membership change.
+type ClusterEvent struct {
+	Type    ClusterEventType
+	Cluster ClusterInfoInterface
+}
+
+// ClusterProvider discovers clusters dynamically.
+// Run sends an event on the events channel every time a cluster is added, updated or removed,
+// and blocks until ctx is done or the provider fails.
+type ClusterProvider interface {
+	Run(ctx context.Context, events chan<- ClusterEvent) error
+}
+
+// StaticClusterProvider is a ClusterProvider for a fixed list of clusters.
+type StaticClusterProvider struct {
+	Clusters []ClusterInfoInterface
+}
+
+// NewStaticClusterProvider creates a provider that reports every given cluster as added once.
+func NewStaticClusterProvider(clusters ...ClusterInfoInterface) *StaticClusterProvider {
+	return &StaticClusterProvider{Clusters: clusters}
+}
+
+// Run implements ClusterProvider.
+func (p *StaticClusterProvider) Run(ctx context.Context, events chan<- ClusterEvent) error {
+	for i := range p.Clusters {
+		if !sendClusterEvent(ctx, events, ClusterEvent{Type: ClusterAdded, Cluster: p.Clusters[i]}) {
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// sendClusterEvent sends e unless ctx is done first. It reports whether e was sent.
+func sendClusterEvent(ctx context.Context, events chan<- ClusterEvent, e ClusterEvent) bool {
+	select {
+	case events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,172 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// chanProvider is a ClusterProvider forwarding the events sent on its channel, until it is told to fail.
+type chanProvider struct {
+	events chan ClusterEvent
+	fail   chan error
+}
+
+func newChanProvider() *chanProvider {
+	return &chanProvider{events: make(chan ClusterEvent), fail: make(chan error)}
+}
+
+func (p *chanProvider) Run(ctx context.Context, events chan<- ClusterEvent) error {
+	for {
+		select {
+		case e := <-p.events:
+			if !sendClusterEvent(ctx, events, e) {
+				return nil
+			}
+		case err := <-p.fail:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// send sends an event to the job, failing the test if it is not received in time.
+func (p *chanProvider) send(t *testing.T, typ ClusterEventType, cluster ClusterInfoInterface) {
+	t.Helper()
+	select {
+	case p.events <- ClusterEvent{Type: typ, Cluster: cluster}:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out sending the %s event", typ)
+	}
+}
+
+// watchProvider runs w.WatchClusterProvider(p), and returns a channel receiving its result.
+func watchProvider(w *WatchJob, p ClusterProvider) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- w.WatchClusterProvider(p)
+	}()
+	return done
+}
+
+// clustersAre reports whether the job watches exactly the given clusters.
+func clustersAre(w *WatchJob, want ...string) func() bool {
+	return func() bool {
+		return reflect.DeepEqual(w.ListClusters(), want)
+	}
+}
+
+func TestWatchClusterProvider(t *testing.T) {
+	w, recorder, newCluster := newLifecycleTestJob(t)
+	defer w.StopWatchAndDrain()
+	p := newChanProvider()
+	done := watchProvider(w, p)
+
+	p.send(t, ClusterAdded, newCluster("a"))
+	p.send(t, ClusterAdded, newCluster("b"))
+	waitUntil(t, "the added clusters", clustersAre(w, "a", "b"))
+
+	// new labels are applied to the running cluster
+	host := newCluster("a").RestConfig().Host
+	p.send(t, ClusterUpdated, NewClusterWithCfg("a", &rest.Config{Host: host}, WithLabels(map[string]string{"env": "prod"})))
+	waitUntil(t, "the new labels", func() bool {
+		s, ok := w.GetClusterStatus("a")
+		return ok && s.Labels["env"] == "prod"
+	})
+	// a new connection restarts the cluster
+	p.send(t, ClusterUpdated, NewClusterWithCfg("b", &rest.Config{Host: host, UserAgent: "other"}))
+	waitUntil(t, "the restart of the updated cluster", func() bool {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return recorder.starting["b"] == 2
+	})
+	// an update of an unknown cluster adds it
+	p.send(t, ClusterUpdated, newCluster("c"))
+	waitUntil(t, "the updated cluster", clustersAre(w, "a", "b", "c"))
+
+	p.send(t, ClusterRemoved, newCluster("a"))
+	waitUntil(t, "the removal", clustersAre(w, "b", "c"))
+	// invalid events are ignored
+	p.send(t, "Renamed", newCluster("d"))
+	p.send(t, ClusterRemoved, nil)
+	p.send(t, ClusterRemoved, newCluster("unknown"))
+	p.send(t, ClusterAdded, newCluster("e"))
+	waitUntil(t, "the cluster added after the invalid events", clustersAre(w, "b", "c", "e"))
+
+	recorder.mu.Lock()
+	if recorder.starting["a"] != 1 || recorder.stopped["a"] != 1 {
+		t.Errorf("cluster a started %d times, stopped %d times", recorder.starting["a"], recorder.stopped["a"])
+	}
+	recorder.mu.Unlock()
+
+	// WatchClusterProvider returns the error of the provider, the clusters keep running
+	failure := errors.New("provider failed")
+	select {
+	case p.fail <- failure:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out failing the provider")
+	}
+	select {
+	case err := <-done:
+		if err != failure {
+			t.Errorf("WatchClusterProvider returned %v, want the error of the provider", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("WatchClusterProvider did not return when the provider failed")
+	}
+	if got := w.ListClusters(); !reflect.DeepEqual(got, []string{"b", "c", "e"}) {
+		t.Errorf("clusters %v once the provider failed, want them kept", got)
+	}
+}
+
+func TestWatchClusterProviderStopped(t *testing.T) {
+	w, recorder, newCluster := newLifecycleTestJob(t)
+	done := watchProvider(w, NewStaticClusterProvider(newCluster("a"), newCluster("b")))
+	waitUntil(t, "the static clusters", clustersAre(w, "a", "b"))
+
+	w.StopWatchAndDrain()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WatchClusterProvider returned %v once the job stopped", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("WatchClusterProvider did not return when the job stopped")
+	}
+	recorder.balanced(t)
+}
+
+func TestStaticClusterProvider(t *testing.T) {
+	a, b := NewClusterWithCfg("a", &rest.Config{}), NewClusterWithCfg("b", &rest.Config{})
+	p := NewStaticClusterProvider(a, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan ClusterEvent, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx, events)
+	}()
+	for _, want := range []ClusterInfoInterface{a, b} {
+		if e := <-events; e.Type != ClusterAdded || e.Cluster != want {
+			t.Errorf("event %s of %s, want %s added", e.Type, e.Cluster.GetClusterName(), want.GetClusterName())
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v before its context is done", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+
+	// Run does not block on events nobody receives once its context is done
+	if err := p.Run(ctx, make(chan ClusterEvent)); err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
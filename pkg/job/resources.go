@@ -1,24 +1,83 @@
 package job
 
 import (
+	"errors"
+	"fmt"
+	"github.com/wangguoyan/mc-operator/pkg/cluster"
 	"github.com/wangguoyan/mc-operator/pkg/controller"
+	"github.com/wangguoyan/mc-operator/pkg/handler"
 	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	ctl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
 )
 
 // WatchResource 监听资源，包括类型和监听方法
 type WatchResource struct {
+	ObjectType client.Object
+	Scheme     *runtime.Scheme
+	// Reconciler or ContextReconciler reconciles the resource. Exactly one of them must be set.
+	Reconciler reconcile.Reconciler
+	// ContextReconciler is given a context cancelled when ReconcileTimeout expires, or at the end of the grace
+	// period (ControllerOptions.GracePeriod) once the cluster is no longer watched or the job is stopped.
+	ContextReconciler reconcile.ContextReconciler
+	// ReconcileTimeout is the timeout of each reconcile. If unset, ControllerOptions.ReconcileTimeout is used,
+	// and if neither is set, reconciles have no timeout. Either is overridden by the ReconcileTimeout set on the
+	// cluster with WithControllerOptions.
+	ReconcileTimeout time.Duration
+	WatchOptions     controller.WatchOptions
+	Owner            *Owner
+	// Watches are the other resources whose events enqueue objects of the resource, through their MapFunc.
+	Watches []Watch
+	// ClusterSelector selects the clusters the resource is watched in, based on their labels.
+	// If unset, the resource is watched in every cluster.
+	ClusterSelector labels.Selector
+	// ControllerOptions are the options of the controllers of the resource. Queue is ignored,
+	// every controller gets its own queue, which can be tuned with RateLimiter.
+	// The options set on a cluster with WithControllerOptions take precedence.
+	ControllerOptions controller.Options
+	// CacheOptions are the options of the caches of the resource.
+	// The options set on a cluster with WithCacheOptions take precedence.
+	CacheOptions cluster.CacheOptions
+}
+
+// contextReconciler returns the reconciler of the resource as a ContextReconciler.
+func (r *WatchResource) contextReconciler() reconcile.ContextReconciler {
+	if r.ContextReconciler != nil {
+		return r.ContextReconciler
+	}
+	return reconcile.AsContextReconciler(r.Reconciler)
+}
+
+func (r *WatchResource) validate() error {
+	if r.ObjectType == nil {
+		return errors.New("watch resource has no object type")
+	}
+	if (r.Reconciler == nil) == (r.ContextReconciler == nil) {
+		return fmt.Errorf("watch resource %T must have exactly one of Reconciler and ContextReconciler", r.ObjectType)
+	}
+	for i := range r.Watches {
+		if r.Watches[i].ObjectType == nil || r.Watches[i].MapFunc == nil {
+			return fmt.Errorf("watch %d of resource %T must have an object type and a map func", i, r.ObjectType)
+		}
+	}
+	return nil
+}
+
+type Owner struct {
 	ObjectType   client.Object
-	Scheme       *runtime.Scheme
-	Reconciler   reconcile.Reconciler
 	WatchOptions controller.WatchOptions
-	Owner        *Owner
 }
-type Owner struct {
+
+// Watch watches the objects of ObjectType, and enqueues the objects MapFunc maps them to in the same cluster,
+// e.g. the objects referencing a ConfigMap or a Secret.
+type Watch struct {
 	ObjectType   client.Object
+	MapFunc      handler.MapFunc
 	WatchOptions controller.WatchOptions
 }
 
@@ -27,26 +86,168 @@ type ClusterInfoInterface interface {
 	GetApiServer() string
 	RestConfig() *rest.Config
 	GetClusterName() string
+	// GetCAData returns the PEM encoded CA bundle used to verify the apiserver.
+	// If empty, the system trust store is used.
+	GetCAData() []byte
+	// GetCertData and GetKeyData return the PEM encoded client certificate and key, if any.
+	GetCertData() []byte
+	GetKeyData() []byte
+	// GetTLSServerName overrides the server name used to verify the apiserver certificate.
+	GetTLSServerName() string
+	// GetProxyURL returns the URL of the proxy used to reach the apiserver, if any.
+	GetProxyURL() string
+	// GetImpersonate returns the identity to act as.
+	GetImpersonate() rest.ImpersonationConfig
+	// IsInsecure reports whether the apiserver certificate must not be verified.
+	IsInsecure() bool
+	// GetCredentialSource returns the source of rotating bearer tokens, if any.
+	GetCredentialSource() CredentialSource
+	// GetExecProvider returns the exec plugin providing credentials, if any.
+	GetExecProvider() *clientcmdapi.ExecConfig
+	// GetLabels returns the labels of the cluster, such as env, region or tier.
+	GetLabels() map[string]string
+	// GetControllerOptions and GetCacheOptions return the options overriding those of the WatchResources
+	// in the cluster. Only their non zero fields are applied.
+	GetControllerOptions() controller.Options
+	GetCacheOptions() cluster.CacheOptions
 }
 
-func NewClusterDefault(key string) ClusterInfoInterface {
-	return &ClusterInfo{
-		key: key,
-		cfg: ctl.GetConfigOrDie(),
-	}
+func NewClusterDefault(key string, opts ...ClusterInfoOption) ClusterInfoInterface {
+	return NewClusterWithCfg(key, ctl.GetConfigOrDie(), opts...)
 }
-func NewClusterWithCfg(key string, cfg *rest.Config) ClusterInfoInterface {
-	return &ClusterInfo{
+
+// NewClusterWithCfg creates a cluster reached with cfg.
+// The TLS options are ignored, cfg already holds the TLS settings.
+func NewClusterWithCfg(key string, cfg *rest.Config, opts ...ClusterInfoOption) ClusterInfoInterface {
+	c := &ClusterInfo{
 		key: key,
 		cfg: cfg,
 	}
+	for i := range opts {
+		opts[i](c)
+	}
+	return c
+}
+
+// NewClusterWithToken creates a cluster reached at apiServer with a bearer token.
+// The apiserver certificate is verified against the system trust store,
+// unless a CA bundle is given with WithCAData or verification is disabled with WithInsecure.
+func NewClusterWithToken(key, apiServer, token string, opts ...ClusterInfoOption) ClusterInfoInterface {
+	c := &ClusterInfo{
+		key:       key,
+		apiServer: apiServer,
+		token:     token,
+	}
+	for i := range opts {
+		opts[i](c)
+	}
+	return c
+}
+
+// ClusterInfoOption configures a new ClusterInfo.
+type ClusterInfoOption func(*ClusterInfo)
+
+// WithCAData sets the PEM encoded CA bundle used to verify the apiserver.
+func WithCAData(caData []byte) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.caData = caData
+	}
+}
+
+// WithClientCertificate sets the PEM encoded client certificate and key used to authenticate.
+func WithClientCertificate(certData, keyData []byte) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.certData = certData
+		c.keyData = keyData
+	}
+}
+
+// WithTLSServerName sets the server name used to verify the apiserver certificate.
+func WithTLSServerName(serverName string) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.tlsServerName = serverName
+	}
+}
+
+// WithProxyURL sets the URL of the proxy used to reach the apiserver.
+func WithProxyURL(proxyURL string) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.proxyURL = proxyURL
+	}
+}
+
+// WithImpersonate sets the identity to act as.
+func WithImpersonate(impersonate rest.ImpersonationConfig) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.impersonate = impersonate
+	}
+}
+
+// WithInsecure disables the verification of the apiserver certificate.
+// It should only be used for development clusters.
+func WithInsecure() ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.insecure = true
+	}
+}
+
+// WithCredentialSource makes the cluster authenticate with the rotating tokens of src,
+// instead of a static token.
+func WithCredentialSource(src CredentialSource) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.credentialSource = src
+	}
+}
+
+// WithExecProvider makes the cluster authenticate with an exec plugin,
+// which is run again whenever its credentials expire or are rejected.
+func WithExecProvider(exec *clientcmdapi.ExecConfig) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.execProvider = exec
+	}
+}
+
+// WithLabels sets the labels of the cluster, matched by the ClusterSelector of WatchResources.
+func WithLabels(l map[string]string) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.labels = l
+	}
+}
+
+// WithControllerOptions sets the controller options of the cluster, merged over those of the WatchResources.
+// With shared controllers, only MaxConcurrentReconciles applies, as the cap of the cluster in the shared queues.
+func WithControllerOptions(o controller.Options) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.controllerOptions = o
+	}
+}
+
+// WithCacheOptions sets the cache options of the cluster, merged over those of the WatchResources.
+func WithCacheOptions(o cluster.CacheOptions) ClusterInfoOption {
+	return func(c *ClusterInfo) {
+		c.cacheOptions = o
+	}
 }
 
 type ClusterInfo struct {
-	token     string
-	apiServer string
-	cfg       *rest.Config
-	key       string
+	token         string
+	apiServer     string
+	cfg           *rest.Config
+	key           string
+	caData        []byte
+	certData      []byte
+	keyData       []byte
+	tlsServerName string
+	proxyURL      string
+	impersonate   rest.ImpersonationConfig
+	insecure      bool
+
+	credentialSource CredentialSource
+	execProvider     *clientcmdapi.ExecConfig
+	labels           map[string]string
+
+	controllerOptions controller.Options
+	cacheOptions      cluster.CacheOptions
 }
 
 func (c *ClusterInfo) GetToken() string {
@@ -61,3 +262,39 @@ func (c *ClusterInfo) RestConfig() *rest.Config {
 func (c *ClusterInfo) GetClusterName() string {
 	return c.key
 }
+func (c *ClusterInfo) GetCAData() []byte {
+	return c.caData
+}
+func (c *ClusterInfo) GetCertData() []byte {
+	return c.certData
+}
+func (c *ClusterInfo) GetKeyData() []byte {
+	return c.keyData
+}
+func (c *ClusterInfo) GetTLSServerName() string {
+	return c.tlsServerName
+}
+func (c *ClusterInfo) GetProxyURL() string {
+	return c.proxyURL
+}
+func (c *ClusterInfo) GetImpersonate() rest.ImpersonationConfig {
+	return c.impersonate
+}
+func (c *ClusterInfo) IsInsecure() bool {
+	return c.insecure
+}
+func (c *ClusterInfo) GetCredentialSource() CredentialSource {
+	return c.credentialSource
+}
+func (c *ClusterInfo) GetExecProvider() *clientcmdapi.ExecConfig {
+	return c.execProvider
+}
+func (c *ClusterInfo) GetLabels() map[string]string {
+	return c.labels
+}
+func (c *ClusterInfo) GetControllerOptions() controller.Options {
+	return c.controllerOptions
+}
+func (c *ClusterInfo) GetCacheOptions() cluster.CacheOptions {
+	return c.cacheOptions
+}
@@ -0,0 +1,280 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	clientgocache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ClusterSecretTypeLabel is the label selecting cluster Secrets by default.
+	ClusterSecretTypeLabel = "mc-controller.io/secret-type"
+	// ClusterSecretTypeCluster is the value of ClusterSecretTypeLabel for cluster Secrets.
+	ClusterSecretTypeCluster = "cluster"
+
+	// ClusterSecretNameKey is the optional data key holding the cluster name.
+	// The Secret name is used when it is missing.
+	ClusterSecretNameKey = "name"
+	// ClusterSecretServerKey is the data key holding the apiserver URL.
+	ClusterSecretServerKey = "server"
+	// ClusterSecretConfigKey is the data key holding the JSON encoded ClusterSecretConfig.
+	ClusterSecretConfigKey = "config"
+)
+
+// ClusterSecretConfig is the connection config stored in a cluster Secret.
+// It uses the same layout as Argo CD cluster Secrets, so those can be consumed as is.
+type ClusterSecretConfig struct {
+	BearerToken     string                 `json:"bearerToken,omitempty"`
+	TLSClientConfig ClusterSecretTLSConfig `json:"tlsClientConfig,omitempty"`
+}
+
+// ClusterSecretTLSConfig holds the TLS part of a ClusterSecretConfig.
+type ClusterSecretTLSConfig struct {
+	Insecure   bool   `json:"insecure,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	CAData     []byte `json:"caData,omitempty"`
+	CertData   []byte `json:"certData,omitempty"`
+	KeyData    []byte `json:"keyData,omitempty"`
+}
+
+// SecretClusterProvider is a ClusterProvider backed by cluster Secrets stored in a hub cluster.
+// Every selected Secret describes one member cluster, labeled with the Secret's labels. Creating a Secret adds the cluster,
+// changing it (e.g. rotating its token) updates the cluster and deleting it removes the cluster.
+// The Secrets are listed and watched with Namespace and Selector, so only the selected Secrets are cached,
+// and only the RBAC to read the Secrets of Namespace is needed when it is set. They are watched with a client-go
+// informer rather than a cluster.Cluster cache: the cache needs a rest.Config and the discovery of the hub,
+// while the informer works with any Client, e.g. a fake clientset in tests.
+// A Secret whose cluster name is already described by another Secret, e.g. in another namespace, is ignored
+// until the other Secret is deleted or renamed; the cluster is then updated with the ignored Secret.
+type SecretClusterProvider struct {
+	// Hub is the cluster the Secrets are read from. It is ignored if Client is set.
+	Hub ClusterInfoInterface
+	// Client is the client of the Secrets. It defaults to a client of Hub.
+	Client kubernetes.Interface
+	// Namespace can be used to only consider Secrets of a single namespace.
+	// If unset (Namespace == ""), Secrets of all namespaces are considered.
+	Namespace string
+	// Selector selects the cluster Secrets.
+	// If unset, Secrets labeled ClusterSecretTypeLabel=ClusterSecretTypeCluster are selected.
+	Selector labels.Selector
+	// Resync is the period between resyncs of the Secrets. If unset, they are not resynced.
+	Resync time.Duration
+
+	mu sync.Mutex
+	// secrets maps the valid selected Secrets to the cluster they describe.
+	secrets map[types.NamespacedName]ClusterInfoInterface
+	// owners maps the names of the clusters reported so far to the Secret they were reported for.
+	owners map[string]reportedSecret
+}
+
+// reportedSecret is a Secret, and the cluster reported for it.
+type reportedSecret struct {
+	key     types.NamespacedName
+	cluster ClusterInfoInterface
+}
+
+// NewSecretClusterProvider creates a SecretClusterProvider reading the Secrets of namespace in hub.
+func NewSecretClusterProvider(hub ClusterInfoInterface, namespace string) *SecretClusterProvider {
+	return &SecretClusterProvider{Hub: hub, Namespace: namespace}
+}
+
+// client returns the client of the Secrets.
+func (p *SecretClusterProvider) client() (kubernetes.Interface, error) {
+	if p.Client != nil {
+		return p.Client, nil
+	}
+	if p.Hub == nil {
+		return nil, fmt.Errorf("secret cluster provider has no hub cluster")
+	}
+	cfg, err := GetCfgByClusterInfo(p.Hub)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+func (p *SecretClusterProvider) selector() labels.Selector {
+	if p.Selector != nil {
+		return p.Selector
+	}
+	return labels.SelectorFromSet(labels.Set{ClusterSecretTypeLabel: ClusterSecretTypeCluster})
+}
+
+// Run implements ClusterProvider.
+func (p *SecretClusterProvider) Run(ctx context.Context, events chan<- ClusterEvent) error {
+	client, err := p.client()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.secrets = map[types.NamespacedName]ClusterInfoInterface{}
+	p.owners = map[string]reportedSecret{}
+	p.mu.Unlock()
+
+	selector := p.selector().String()
+	informer := corev1informers.NewFilteredSecretInformer(client, p.Namespace, p.Resync, clientgocache.Indexers{},
+		func(o *metav1.ListOptions) {
+			o.LabelSelector = selector
+		})
+	informer.AddEventHandler(clientgocache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.sync(ctx, events, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			o, okOld := oldObj.(*corev1.Secret)
+			n, okNew := newObj.(*corev1.Secret)
+			if okOld && okNew && o.ResourceVersion == n.ResourceVersion {
+				// periodic resync, nothing changed
+				return
+			}
+			p.sync(ctx, events, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// a Secret that is no longer selected is deleted from the informer too
+			if tombstone, ok := obj.(clientgocache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if s, ok := obj.(*corev1.Secret); ok {
+				p.remove(ctx, events, types.NamespacedName{Namespace: s.Namespace, Name: s.Name})
+			}
+		},
+	})
+	informer.Run(ctx.Done())
+	return nil
+}
+
+// sync reports the cluster described by obj as added or updated,
+// and the cluster it described before as removed if its name changed.
+func (p *SecretClusterProvider) sync(ctx context.Context, events chan<- ClusterEvent, obj interface{}) {
+	s, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	key := types.NamespacedName{Namespace: s.Namespace, Name: s.Name}
+	info, err := ClusterFromSecret(s)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Ignore cluster secret", "secret", key)
+		return
+	}
+
+	p.mu.Lock()
+	var changes []ClusterEvent
+	old, known := p.secrets[key]
+	p.secrets[key] = info
+	if known && old.GetClusterName() != info.GetClusterName() {
+		changes = p.resolve(ctx, old.GetClusterName(), key)
+	}
+	changes = append(changes, p.resolve(ctx, info.GetClusterName(), key)...)
+	p.mu.Unlock()
+
+	for _, e := range changes {
+		if !sendClusterEvent(ctx, events, e) {
+			return
+		}
+	}
+}
+
+// remove reports the cluster of the Secret key as removed, unless another Secret describes it.
+func (p *SecretClusterProvider) remove(ctx context.Context, events chan<- ClusterEvent, key types.NamespacedName) {
+	p.mu.Lock()
+	var changes []ClusterEvent
+	if old, known := p.secrets[key]; known {
+		delete(p.secrets, key)
+		changes = p.resolve(ctx, old.GetClusterName(), key)
+	}
+	p.mu.Unlock()
+
+	for _, e := range changes {
+		if !sendClusterEvent(ctx, events, e) {
+			return
+		}
+	}
+}
+
+// resolve returns the events of the cluster name after the Secret changed was added, updated or removed.
+// The cluster stays reported for its Secret as long as the Secret describes it. Otherwise it is reported for
+// the first other Secret describing it, if any, and removed if there is none. It must be called with mu held.
+func (p *SecretClusterProvider) resolve(ctx context.Context, name string, changed types.NamespacedName) []ClusterEvent {
+	owner, reported := p.owners[name]
+	if reported {
+		if info, ok := p.secrets[owner.key]; ok && info.GetClusterName() == name {
+			if owner.key == changed {
+				p.owners[name] = reportedSecret{key: owner.key, cluster: info}
+				return []ClusterEvent{{Type: ClusterUpdated, Cluster: info}}
+			}
+			if info, ok := p.secrets[changed]; ok && info.GetClusterName() == name {
+				klog.FromContext(ctx).Error(nil, "Ignore cluster secret, its cluster name is taken by another secret",
+					"secret", changed, "cluster", name, "other", owner.key)
+			}
+			return nil
+		}
+	}
+
+	var next *types.NamespacedName
+	for key, info := range p.secrets {
+		if info.GetClusterName() == name && (next == nil || key.String() < next.String()) {
+			key := key
+			next = &key
+		}
+	}
+	if next == nil {
+		if !reported {
+			return nil
+		}
+		delete(p.owners, name)
+		return []ClusterEvent{{Type: ClusterRemoved, Cluster: owner.cluster}}
+	}
+	info := p.secrets[*next]
+	p.owners[name] = reportedSecret{key: *next, cluster: info}
+	if other, ok := p.secrets[changed]; ok && changed != *next && other.GetClusterName() == name {
+		klog.FromContext(ctx).Error(nil, "Ignore cluster secret, its cluster name is taken by another secret",
+			"secret", changed, "cluster", name, "other", *next)
+	}
+	if reported {
+		// another Secret takes the cluster over
+		return []ClusterEvent{{Type: ClusterUpdated, Cluster: info}}
+	}
+	return []ClusterEvent{{Type: ClusterAdded, Cluster: info}}
+}
+
+// ClusterFromSecret builds the cluster described by a cluster Secret.
+func ClusterFromSecret(s *corev1.Secret) (ClusterInfoInterface, error) {
+	server := string(s.Data[ClusterSecretServerKey])
+	if server == "" {
+		return nil, fmt.Errorf("missing %q", ClusterSecretServerKey)
+	}
+	name := string(s.Data[ClusterSecretNameKey])
+	if name == "" {
+		name = s.Name
+	}
+
+	var config ClusterSecretConfig
+	if raw := s.Data[ClusterSecretConfigKey]; len(raw) > 0 {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, fmt.Errorf("invalid %q: %w", ClusterSecretConfigKey, err)
+		}
+	}
+
+	tls := config.TLSClientConfig
+	opts := []ClusterInfoOption{
+		WithCAData(tls.CAData),
+		WithClientCertificate(tls.CertData, tls.KeyData),
+		WithTLSServerName(tls.ServerName),
+		WithLabels(s.Labels),
+	}
+	if tls.Insecure {
+		opts = append(opts, WithInsecure())
+	}
+	return NewClusterWithToken(name, server, config.BearerToken, opts...), nil
+}
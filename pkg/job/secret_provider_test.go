@@ -0,0 +1,164 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func clusterSecret(namespace, name, token string, labeled bool) *corev1.Secret {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"env": "test"}},
+		Data: map[string][]byte{
+			ClusterSecretServerKey: []byte("https://" + name + ".example.com"),
+			ClusterSecretConfigKey: []byte(`{"bearerToken":"` + token + `"}`),
+		},
+	}
+	if labeled {
+		s.Labels[ClusterSecretTypeLabel] = ClusterSecretTypeCluster
+	}
+	return s
+}
+
+func nextClusterEvent(t *testing.T, events <-chan ClusterEvent) ClusterEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a cluster event")
+		return ClusterEvent{}
+	}
+}
+
+func TestSecretClusterProvider(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		clusterSecret("mc-system", "a", "token-1", true),
+		clusterSecret("other", "b", "token-1", true),
+		clusterSecret("mc-system", "c", "token-1", false),
+	)
+	p := &SecretClusterProvider{Client: client, Namespace: "mc-system"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan ClusterEvent)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.Run(ctx, events)
+	}()
+
+	e := nextClusterEvent(t, events)
+	if e.Type != ClusterAdded || e.Cluster.GetClusterName() != "a" || e.Cluster.GetToken() != "token-1" {
+		t.Fatalf("unexpected event %s %s", e.Type, e.Cluster.GetClusterName())
+	}
+	if e.Cluster.GetLabels()["env"] != "test" {
+		t.Errorf("cluster labels = %v, want the labels of the Secret", e.Cluster.GetLabels())
+	}
+
+	// the Secrets are listed with the namespace and the selector
+	for _, a := range client.Actions() {
+		list, ok := a.(clienttesting.ListAction)
+		if !ok {
+			continue
+		}
+		if list.GetNamespace() != "mc-system" {
+			t.Errorf("Secrets listed in namespace %q", list.GetNamespace())
+		}
+		if got := list.GetListRestrictions().Labels.String(); got != ClusterSecretTypeLabel+"="+ClusterSecretTypeCluster {
+			t.Errorf("Secrets listed with selector %q", got)
+		}
+	}
+
+	rotated := clusterSecret("mc-system", "a", "token-2", true)
+	rotated.ResourceVersion = "2"
+	if _, err := client.CoreV1().Secrets("mc-system").Update(ctx, rotated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	e = nextClusterEvent(t, events)
+	if e.Type != ClusterUpdated || e.Cluster.GetToken() != "token-2" {
+		t.Fatalf("unexpected event %s with token %s", e.Type, e.Cluster.GetToken())
+	}
+
+	if err := client.CoreV1().Secrets("mc-system").Delete(ctx, "a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	e = nextClusterEvent(t, events)
+	if e.Type != ClusterRemoved || e.Cluster.GetClusterName() != "a" {
+		t.Fatalf("unexpected event %s %s", e.Type, e.Cluster.GetClusterName())
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretClusterProviderNameCollision(t *testing.T) {
+	named := func(namespace string) *corev1.Secret {
+		s := clusterSecret(namespace, "a", "token-"+namespace, true)
+		s.Data[ClusterSecretNameKey] = []byte("prod")
+		return s
+	}
+	client := fake.NewSimpleClientset(named("one"), named("two"))
+	p := &SecretClusterProvider{Client: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan ClusterEvent)
+	go func() {
+		_ = p.Run(ctx, events)
+	}()
+
+	// only one of the Secrets describing the cluster is reported
+	e := nextClusterEvent(t, events)
+	if e.Type != ClusterAdded || e.Cluster.GetClusterName() != "prod" {
+		t.Fatalf("unexpected event %s %s", e.Type, e.Cluster.GetClusterName())
+	}
+	owner, other := "one", "two"
+	if e.Cluster.GetToken() == "token-two" {
+		owner, other = other, owner
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %s %s for the Secret whose cluster name is taken", e.Type, e.Cluster.GetClusterName())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// deleting the reported Secret does not remove the cluster, the other Secret takes it over
+	if err := client.CoreV1().Secrets(owner).Delete(ctx, "a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	e = nextClusterEvent(t, events)
+	if e.Type != ClusterUpdated || e.Cluster.GetClusterName() != "prod" || e.Cluster.GetToken() != "token-"+other {
+		t.Fatalf("unexpected event %s %s with token %s, want the cluster of the other Secret",
+			e.Type, e.Cluster.GetClusterName(), e.Cluster.GetToken())
+	}
+
+	if err := client.CoreV1().Secrets(other).Delete(ctx, "a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	e = nextClusterEvent(t, events)
+	if e.Type != ClusterRemoved || e.Cluster.GetClusterName() != "prod" {
+		t.Fatalf("unexpected event %s %s", e.Type, e.Cluster.GetClusterName())
+	}
+}
+
+func TestClusterFromSecret(t *testing.T) {
+	s := clusterSecret("mc-system", "a", "token", true)
+	s.Data[ClusterSecretNameKey] = []byte("prod")
+	info, err := ClusterFromSecret(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GetClusterName() != "prod" || info.GetApiServer() != "https://a.example.com" {
+		t.Errorf("cluster = %s at %s", info.GetClusterName(), info.GetApiServer())
+	}
+
+	delete(s.Data, ClusterSecretServerKey)
+	if _, err := ClusterFromSecret(s); err == nil {
+		t.Error("a Secret without server must be rejected")
+	}
+}
@@ -0,0 +1,274 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/wangguoyan/mc-operator/pkg/util"
+	"hash/fnv"
+	"os"
+	"sort"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// shardGroupLabel labels the Leases of the replicas of a sharded job with the name of the job.
+const shardGroupLabel = "mc-controller.io/shard-group"
+
+// ShardingOptions configures the sharding of the clusters of a WatchJob across its replicas.
+// Every replica renews a Lease of its own in a home cluster, and the live replicas are those whose Lease
+// is not expired. Clusters are assigned to the live replicas by consistent hashing on their name,
+// and every replica only watches the clusters it owns.
+type ShardingOptions struct {
+	// HomeCluster is the cluster holding the Leases. It is ignored if Client is set.
+	HomeCluster ClusterInfoInterface
+	// Client is the client of the Leases. It defaults to a client of HomeCluster.
+	Client coordinationv1client.LeasesGetter
+	// Namespace is the namespace of the Leases, and Name the name of the job, shared by its replicas.
+	// The Lease of a replica is named after the job and a hash of the identity of the replica,
+	// as identities are not valid object names, e.g. the default one.
+	Namespace string
+	Name      string
+	// Identity is the identity of the replica. Defaults to the hostname followed by a random suffix.
+	Identity string
+	// LeaseDuration is how long a replica is considered alive after renewing its Lease. Defaults to 15 seconds.
+	LeaseDuration time.Duration
+	// RenewPeriod is the period between two renewals of the Lease of the replica,
+	// and between two updates of the live replicas. Defaults to 5 seconds.
+	RenewPeriod time.Duration
+	// VirtualNodes is the number of virtual nodes of every replica on the hash ring. Defaults to 100.
+	VirtualNodes int
+}
+
+func (o *ShardingOptions) setDefaults() {
+	if o.Identity == "" {
+		hostname, _ := os.Hostname()
+		o.Identity = hostname + "_" + string(uuid.NewUUID())
+	}
+	if o.LeaseDuration <= 0 {
+		o.LeaseDuration = 15 * time.Second
+	}
+	if o.RenewPeriod <= 0 {
+		o.RenewPeriod = 5 * time.Second
+	}
+	if o.VirtualNodes <= 0 {
+		o.VirtualNodes = 100
+	}
+}
+
+// client returns the client of the Leases.
+func (o *ShardingOptions) client() (coordinationv1client.LeasesGetter, error) {
+	if o.Client != nil {
+		return o.Client, nil
+	}
+	if o.HomeCluster == nil {
+		return nil, errors.New("sharding needs a home cluster or a client")
+	}
+	cfg, err := GetCfgByClusterInfo(o.HomeCluster)
+	if err != nil {
+		return nil, err
+	}
+	return coordinationv1client.NewForConfig(cfg)
+}
+
+// leaseName returns the name of the Lease of the replica. The identity is hashed,
+// as it may contain characters that are not allowed in a DNS-1123 subdomain, like the underscore of the default.
+func (o *ShardingOptions) leaseName() string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(o.Identity))
+	return fmt.Sprintf("%s-%016x", o.Name, h.Sum64())
+}
+
+// WithSharding shards the clusters of the job across its replicas. The clusters given to StartResourceWatch,
+// AddResourceWatch, UpdateResourceWatch and the cluster providers are the desired clusters of the job,
+// but the replica only watches those it owns. Clusters are rebalanced when a replica joins or leaves.
+// With sharding, StartResourceWatch blocks until the job is stopped, as its clusters can move between replicas.
+// Moving clusters are not fenced: the previous owner stops a cluster at its next update of the live replicas,
+// so two replicas may reconcile the same cluster for up to RenewPeriod, and the reconcilers must tolerate it.
+// Likewise, a replica that cannot renew its Lease stops its clusters up to RenewPeriod after the Lease expired.
+// It must be called before the job starts watching clusters, and cannot be combined with WithLeaderElection:
+// such a job is stopped as soon as it starts, with ErrShardingWithLeaderElection.
+func (w *WatchJob) WithSharding(o ShardingOptions) *WatchJob {
+	o.setDefaults()
+	w.sharding = &o
+	if w.leaderElection != nil {
+		w.err = ErrShardingWithLeaderElection
+	}
+	return w
+}
+
+// ShardMembers returns the identities of the live replicas of a sharded job, sorted.
+func (w *WatchJob) ShardMembers() []string {
+	w.shardMu.RLock()
+	defer w.shardMu.RUnlock()
+	return append([]string(nil), w.shardMembers...)
+}
+
+// owns reports whether the replica watches the cluster, which is always the case without sharding.
+// A sharded replica owns no cluster until it knows the live replicas.
+func (w *WatchJob) owns(clusterName string) bool {
+	if w.sharding == nil {
+		return true
+	}
+	w.shardMu.RLock()
+	defer w.shardMu.RUnlock()
+	return w.ring != nil && w.ring.Get(clusterName) == w.sharding.Identity
+}
+
+// runSharding renews the Lease of the replica and updates the live replicas until ctx is done,
+// rebalancing the clusters every time.
+func (w *WatchJob) runSharding(ctx context.Context) {
+	o := w.sharding
+	logger := w.logger.WithValues("shardGroup", o.Name, "identity", o.Identity)
+	client, err := o.client()
+	if err != nil {
+		logger.Error(err, "Sharding failed, stop the job")
+		w.callFailedHooks("", err)
+		w.StopWatch()
+		return
+	}
+	leases := client.Leases(o.Namespace)
+	defer func() {
+		// leave the group right away, instead of waiting for the Lease to expire
+		if err := leases.Delete(context.Background(), o.leaseName(), v1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "Delete Lease failed")
+		}
+	}()
+
+	var lastRenew time.Time
+	ticker := time.NewTicker(o.RenewPeriod)
+	defer ticker.Stop()
+	for {
+		if err := w.renewShardLease(ctx, leases); err != nil {
+			logger.Error(err, "Renew Lease failed")
+		} else {
+			lastRenew = time.Now()
+		}
+		var members []string
+		if time.Since(lastRenew) < o.LeaseDuration {
+			if members, err = w.liveShardMembers(ctx, leases); err != nil {
+				logger.Error(err, "List Leases failed")
+				members = w.ShardMembers()
+			}
+		} else {
+			// the others consider the replica dead, and took over its clusters
+			members = nil
+		}
+		w.setShardMembers(logger, members)
+		w.rebalance()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewShardLease creates or renews the Lease of the replica.
+func (w *WatchJob) renewShardLease(ctx context.Context, leases coordinationv1client.LeaseInterface) error {
+	o := w.sharding
+	now := v1.NewMicroTime(time.Now())
+	seconds := int32(o.LeaseDuration / time.Second)
+	lease, err := leases.Get(ctx, o.leaseName(), v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      o.leaseName(),
+				Namespace: o.Namespace,
+				Labels:    map[string]string{shardGroupLabel: o.Name},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &o.Identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, v1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = &o.Identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, v1.UpdateOptions{})
+	return err
+}
+
+// liveShardMembers returns the identities of the replicas whose Lease is not expired, sorted.
+func (w *WatchJob) liveShardMembers(ctx context.Context, leases coordinationv1client.LeaseInterface) ([]string, error) {
+	list, err := leases.List(ctx, v1.ListOptions{LabelSelector: shardGroupLabel + "=" + w.sharding.Name})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var members []string
+	for i := range list.Items {
+		spec := list.Items[i].Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expiry) {
+			members = append(members, *spec.HolderIdentity)
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// setShardMembers updates the hash ring if the live replicas changed.
+func (w *WatchJob) setShardMembers(logger logr.Logger, members []string) {
+	w.shardMu.Lock()
+	defer w.shardMu.Unlock()
+	if w.ring != nil && equalStrings(w.shardMembers, members) {
+		return
+	}
+	logger.Info("Shard members changed, rebalance clusters", "members", members)
+	w.shardMembers = members
+	w.ring = util.NewHashRing(w.sharding.VirtualNodes, members...)
+}
+
+// rebalance starts the desired clusters the replica owns, and stops the watched clusters it no longer owns.
+func (w *WatchJob) rebalance() {
+	if w.jobContext().Err() != nil {
+		return
+	}
+	w.desired.Range(func(key interface{}, _ interface{}) bool {
+		w.membershipMu.Lock()
+		defer w.membershipMu.Unlock()
+		// the cluster may have been removed or updated since the range started
+		if info, ok := w.desired.Load(key); ok && w.owns(key.(string)) {
+			w.startCluster(info.(ClusterInfoInterface))
+		}
+		return true
+	})
+	w.clusters.Range(func(key interface{}, _ interface{}) bool {
+		w.membershipMu.Lock()
+		defer w.membershipMu.Unlock()
+		if !w.owns(key.(string)) {
+			w.stopCluster(key.(string))
+		}
+		return true
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
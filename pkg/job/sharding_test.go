@@ -0,0 +1,201 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/wangguoyan/mc-operator/pkg/util"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// newShardedTestJob creates a lifecycle test job sharded with the Leases of client, and starts it with clusters.
+func newShardedTestJob(t *testing.T, client coordinationv1client.LeasesGetter, identity string, clusters []string) *WatchJob {
+	t.Helper()
+	w, _, newCluster := newLifecycleTestJob(t)
+	w.WithSharding(ShardingOptions{
+		Client:        client,
+		Namespace:     "default",
+		Name:          "mc-operator",
+		Identity:      identity,
+		LeaseDuration: time.Second,
+		RenewPeriod:   50 * time.Millisecond,
+	})
+	for _, name := range clusters {
+		if err := w.AddResourceWatch(newCluster(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(w.StopWatch)
+	return w
+}
+
+// shardedClusters returns the names of n clusters.
+func shardedClusters(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("cluster-%02d", i)
+	}
+	return names
+}
+
+// ownedBy returns the clusters the ring of members assigns to member, sorted.
+func ownedBy(member string, clusters []string, members ...string) []string {
+	ring := util.NewHashRing(100, members...)
+	var owned []string
+	for _, name := range clusters {
+		if ring.Get(name) == member {
+			owned = append(owned, name)
+		}
+	}
+	sort.Strings(owned)
+	return owned
+}
+
+// watches reports whether the job watches exactly want.
+func watches(w *WatchJob, want []string) func() bool {
+	return func() bool {
+		return reflect.DeepEqual(w.ListClusters(), want)
+	}
+}
+
+func TestShardingSplitAndRebalance(t *testing.T) {
+	client := fake.NewSimpleClientset().CoordinationV1()
+	clusters := shardedClusters(20)
+	a := newShardedTestJob(t, client, "a", clusters)
+	waitUntil(t, "the first replica to own every cluster", watches(a, clusters))
+
+	// a replica joins: the clusters are split between both
+	b := newShardedTestJob(t, client, "b", clusters)
+	ownedByA, ownedByB := ownedBy("a", clusters, "a", "b"), ownedBy("b", clusters, "a", "b")
+	if len(ownedByA) == 0 || len(ownedByB) == 0 {
+		t.Fatalf("the clusters are not split: %v and %v", ownedByA, ownedByB)
+	}
+	waitUntil(t, "the first replica to give up the clusters of the second", watches(a, ownedByA))
+	waitUntil(t, "the second replica to watch its clusters", watches(b, ownedByB))
+
+	// the replica leaves, deleting its Lease: the remaining replica takes its clusters back
+	b.StopWatch()
+	waitUntil(t, "the first replica to take every cluster back", watches(a, clusters))
+	if got := a.ShardMembers(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("members = %v", got)
+	}
+}
+
+func TestShardingLeaseExpiry(t *testing.T) {
+	client := fake.NewSimpleClientset().CoordinationV1()
+	clusters := shardedClusters(20)
+	a := newShardedTestJob(t, client, "a", clusters)
+	waitUntil(t, "the replica to own every cluster", watches(a, clusters))
+
+	// a replica renews its Lease once, then dies without deleting it
+	now := metav1.NewMicroTime(time.Now())
+	holder, seconds := "dead", int32(1)
+	if _, err := client.Leases("default").Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "mc-operator-dead", Labels: map[string]string{shardGroupLabel: "mc-operator"}},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &seconds, RenewTime: &now},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the replica to give up the clusters of the new one", watches(a, ownedBy("a", clusters, "a", "dead")))
+	waitUntil(t, "the replica to take the clusters back once the Lease expired", watches(a, clusters))
+	if got := a.ShardMembers(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("members = %v", got)
+	}
+}
+
+func TestShardingDefaultIdentity(t *testing.T) {
+	o := ShardingOptions{Name: "mc-operator"}
+	o.setDefaults()
+	if errs := validation.IsDNS1123Subdomain(o.leaseName()); len(errs) != 0 {
+		t.Errorf("Lease name %q of the default identity %q is invalid: %v", o.leaseName(), o.Identity, errs)
+	}
+	other := ShardingOptions{Name: "mc-operator"}
+	other.setDefaults()
+	if o.leaseName() == other.leaseName() {
+		t.Errorf("replicas %q and %q have the same Lease", o.Identity, other.Identity)
+	}
+
+	// the replica renews its Lease under that name
+	client := fake.NewSimpleClientset().CoordinationV1()
+	w, _, _ := newLifecycleTestJob(t)
+	w.WithSharding(ShardingOptions{Client: client, Namespace: "default", Name: "mc-operator"})
+	defer w.StopWatch()
+	if err := w.AddResourceWatch(); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the replica to join", func() bool { return len(w.ShardMembers()) == 1 })
+	leases, err := client.Leases("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lease := range leases.Items {
+		if errs := validation.IsDNS1123Subdomain(lease.Name); len(errs) != 0 {
+			t.Errorf("Lease name %q is invalid: %v", lease.Name, errs)
+		}
+	}
+}
+
+func TestShardingRebalanceRace(t *testing.T) {
+	w, recorder, newCluster := newLifecycleTestJob(t)
+	w.WithSharding(ShardingOptions{
+		Client:      fake.NewSimpleClientset().CoordinationV1(),
+		Namespace:   "default",
+		Name:        "mc-operator",
+		Identity:    "only",
+		RenewPeriod: time.Hour,
+	})
+	defer w.StopWatch()
+	if err := w.AddResourceWatch(); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the replica to join", func() bool { return reflect.DeepEqual(w.ShardMembers(), []string{"only"}) })
+
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+	// the cluster is removed after the rebalance listed the desired clusters, but before it starts them
+	w.membershipMu.Lock()
+	rebalanced := make(chan struct{})
+	go func() {
+		defer close(rebalanced)
+		w.rebalance()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w.desired.Delete("a")
+	w.stopCluster("a")
+	w.membershipMu.Unlock()
+	waitFor(t, "the rebalance", rebalanced)
+	if got := w.ListClusters(); len(got) != 0 {
+		t.Fatalf("clusters after the rebalance = %v, want the removed cluster not started again", got)
+	}
+	w.StopWatchAndDrain()
+	recorder.balanced(t)
+}
+
+func TestShardingWithLeaderElection(t *testing.T) {
+	client := fake.NewSimpleClientset().CoordinationV1()
+	w, _, newCluster := newLifecycleTestJob(t)
+	w.WithLeaderElection(LeaderElectionOptions{Client: client, Namespace: "default", Name: "mc-operator"}).
+		WithSharding(ShardingOptions{Client: client, Namespace: "default", Name: "mc-operator"})
+
+	if err := w.AddResourceWatch(newCluster("a")); err != ErrShardingWithLeaderElection {
+		t.Errorf("AddResourceWatch = %v, want ErrShardingWithLeaderElection", err)
+	}
+	if err := w.UpdateResourceWatch(newCluster("a")); err != ErrShardingWithLeaderElection {
+		t.Errorf("UpdateResourceWatch = %v, want ErrShardingWithLeaderElection", err)
+	}
+	if got := w.ListClusters(); len(got) != 0 {
+		t.Errorf("clusters = %v", got)
+	}
+	if w.IsLeader() {
+		t.Error("an invalid job is not the leader")
+	}
+}
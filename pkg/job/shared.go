@@ -0,0 +1,101 @@
+package job
+
+import (
+	"sync"
+
+	"github.com/wangguoyan/mc-operator/pkg/controller"
+)
+
+// sharedController is the controller shared by every cluster for a WatchResource, and its queue.
+type sharedController struct {
+	co    *controller.Controller
+	queue *controller.ClusterFairQueue
+
+	// watches maps the cluster names to the watches of the resource, read without lock on every event.
+	// watchesMu serializes the writes, so that a stopped watch does not remove the watch that replaced it.
+	watches   sync.Map
+	watchesMu sync.Mutex
+}
+
+// watchOf returns the watch of the resource in the given cluster, or nil if it is not watched.
+func (sc *sharedController) watchOf(clusterName string) *resourceWatch {
+	if v, ok := sc.watches.Load(clusterName); ok {
+		return v.(*resourceWatch)
+	}
+	return nil
+}
+
+func (sc *sharedController) addWatch(rw *resourceWatch) {
+	sc.watchesMu.Lock()
+	defer sc.watchesMu.Unlock()
+	sc.watches.Store(rw.cluster, rw)
+}
+
+func (sc *sharedController) removeWatch(rw *resourceWatch) {
+	sc.watchesMu.Lock()
+	defer sc.watchesMu.Unlock()
+	if v, ok := sc.watches.Load(rw.cluster); ok && v == rw {
+		sc.watches.Delete(rw.cluster)
+	}
+}
+
+// WithSharedControllers makes the job run a single controller per WatchResource for all its clusters,
+// with a single queue and a pool of maxConcurrentReconciles workers, instead of one controller,
+// queue and set of workers per resource and cluster.
+// The queue is a controller.ClusterFairQueue, so the Requests of every cluster are processed in turn.
+// Clusters are attached to the shared controllers when they are started, and detached when they are stopped.
+// It must be called before the job starts watching clusters.
+func (w *WatchJob) WithSharedControllers(maxConcurrentReconciles int) *WatchJob {
+	if maxConcurrentReconciles <= 0 {
+		maxConcurrentReconciles = 1
+	}
+	w.sharedWorkers = maxConcurrentReconciles
+	return w
+}
+
+// WithClusterFairness sets the per-cluster weights and concurrency caps of the queues of the shared controllers.
+// It must be called before the job starts watching clusters, and has no effect without WithSharedControllers.
+func (w *WatchJob) WithClusterFairness(o controller.FairQueueOptions) *WatchJob {
+	w.fairness = o
+	return w
+}
+
+// getSharedController returns the shared controller of resource, creating and starting it on first use.
+// It runs until the job is stopped.
+func (w *WatchJob) getSharedController(resource *WatchResource) *sharedController {
+	w.sharedMu.Lock()
+	defer w.sharedMu.Unlock()
+	if sc, ok := w.sharedControllers[resource]; ok {
+		return sc
+	}
+	if w.sharedControllers == nil {
+		w.sharedControllers = map[*WatchResource]*sharedController{}
+	}
+
+	fairness := w.fairness
+	if fairness.RateLimiter == nil {
+		fairness.RateLimiter = resource.ControllerOptions.RateLimiter
+	}
+	fairness.Kind = resourceGVK(resource).Kind
+	queue := controller.NewClusterFairQueue(fairness)
+	o := controllerOptions(resource, nil)
+	if o.MaxConcurrentReconciles <= 0 {
+		o.MaxConcurrentReconciles = w.sharedWorkers
+	}
+	o.Queue = queue
+	sc := &sharedController{queue: queue}
+	sc.co = w.newController(resource, o, sc.watchOf)
+	w.sharedControllers[resource] = sc
+	go func() {
+		ctx := w.jobContext()
+		select {
+		case <-w.elected:
+		case <-ctx.Done():
+			return
+		}
+		if err := sc.co.Start(ctx); err != nil {
+			w.logger.Error(err, "Start shared controller failed", "gvk", resourceGVK(resource))
+		}
+	}()
+	return sc
+}
@@ -0,0 +1,136 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// RestartPolicy configures how a WatchJob restarts the failed watches of a cluster.
+// Each restart tears down and rebuilds the watch's cluster.Cluster, controller and manager.
+type RestartPolicy struct {
+	// InitialBackoff is the delay before the first restart. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two restarts. Defaults to 5 minutes.
+	MaxBackoff time.Duration
+	// Multiplier is the factor applied to the delay after each restart. Defaults to 2.
+	Multiplier float64
+	// Jitter adds a random delay of up to Jitter times the delay. Defaults to 0.1.
+	Jitter float64
+	// MaxRetries is the number of restarts in a row after which a watch is given up.
+	// If unset (MaxRetries == 0), a watch is restarted until its cluster is stopped.
+	MaxRetries int
+	// ResetAfter is how long a watch must run to reset its backoff. Defaults to MaxBackoff.
+	ResetAfter time.Duration
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 5 * time.Minute
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter <= 0 {
+		p.Jitter = 0.1
+	}
+	if p.ResetAfter <= 0 {
+		p.ResetAfter = p.MaxBackoff
+	}
+	return p
+}
+
+func (p RestartPolicy) backoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: p.InitialBackoff,
+		Factor:   p.Multiplier,
+		Jitter:   p.Jitter,
+		Steps:    math.MaxInt32,
+		Cap:      p.MaxBackoff,
+	}
+}
+
+// RestartError is passed to the failed hooks when a failed watch is about to be restarted.
+type RestartError struct {
+	// Resource is the type of the watched resource.
+	Resource string
+	// Attempt is the number of the upcoming restart, starting at 1.
+	Attempt int
+	// Backoff is the delay before the restart.
+	Backoff time.Duration
+	// Err is the error that made the watch fail.
+	Err error
+}
+
+func (e *RestartError) Error() string {
+	return fmt.Sprintf("watch of %s failed, restart %d in %s: %s", e.Resource, e.Attempt, e.Backoff, e.Err.Error())
+}
+
+func (e *RestartError) Unwrap() error {
+	return e.Err
+}
+
+// WithRestartPolicy makes the job restart the failed watches of its clusters with exponential backoff.
+// Without a restart policy, a failed watch is given up until its cluster is restarted.
+func (w *WatchJob) WithRestartPolicy(p RestartPolicy) *WatchJob {
+	p = p.withDefaults()
+	w.restartPolicy = &p
+	return w
+}
+
+// superviseClusterResource watches the resource of rw in its cluster until ctx is cancelled.
+// If the job has a restart policy, the watch is restarted whenever it fails.
+func (w *WatchJob) superviseClusterResource(ctx context.Context, rw *resourceWatch) {
+	name, resource := rw.cluster, rw.resource
+	if w.restartPolicy == nil {
+		started := time.Now()
+		if err := w.watchClusterResource(ctx, rw); err != nil && ctx.Err() == nil {
+			w.watchFailed(name, resource, err, time.Since(started))
+		}
+		return
+	}
+
+	backoff := w.restartPolicy.backoff()
+	attempt := 0
+	for {
+		started := time.Now()
+		err := w.watchClusterResource(ctx, rw)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("watch stopped unexpectedly")
+		}
+		if time.Since(started) >= w.restartPolicy.ResetAfter {
+			backoff = w.restartPolicy.backoff()
+			attempt = 0
+		}
+		attempt++
+		if w.restartPolicy.MaxRetries > 0 && attempt > w.restartPolicy.MaxRetries {
+			w.watchFailed(name, resource, err, time.Since(started))
+			return
+		}
+
+		delay := backoff.Step()
+		w.watchFailed(name, resource, &RestartError{Resource: resourceName(resource), Attempt: attempt, Backoff: delay, Err: err}, time.Since(started))
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		rw.restarted()
+	}
+}
+
+// resourceName returns a readable name of the type of the watched resource.
+func resourceName(resource *WatchResource) string {
+	return fmt.Sprintf("%T", resource.ObjectType)
+}
@@ -0,0 +1,133 @@
+package job
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failureRecorder records the errors a job reports to its failed hooks.
+type failureRecorder struct {
+	mu     sync.Mutex
+	errors []error
+}
+
+func (r *failureRecorder) hook(_ string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, err)
+}
+
+// restarts returns the restarts reported so far, and the number of other errors.
+func (r *failureRecorder) restarts() ([]*RestartError, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var restarts []*RestartError
+	others := 0
+	for _, err := range r.errors {
+		var restart *RestartError
+		if errors.As(err, &restart) {
+			restarts = append(restarts, restart)
+		} else {
+			others++
+		}
+	}
+	return restarts, others
+}
+
+func TestRestartPolicyResumesReconciling(t *testing.T) {
+	srv := newPodAPIServer(t, "x")
+	srv.setDown(true)
+	r := &reconcileRecorder{}
+	w, newCluster := newPodTestJob(t, srv, r)
+	failures := &failureRecorder{}
+	w.AddFailedRollBack(failures.hook).WithRestartPolicy(RestartPolicy{
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Jitter:         0.01,
+	})
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, "three restarts", func() bool {
+		restarts, _ := failures.restarts()
+		return len(restarts) >= 3
+	})
+	restarts, others := failures.restarts()
+	for i, restart := range restarts[:3] {
+		if restart.Attempt != i+1 {
+			t.Errorf("restart %d reported as attempt %d", i+1, restart.Attempt)
+		}
+		if i > 0 && restart.Backoff < restarts[i-1].Backoff*3/2 {
+			t.Errorf("backoff %s after %s, want it to grow", restart.Backoff, restarts[i-1].Backoff)
+		}
+	}
+	if others != 0 {
+		t.Errorf("%d failures were not restarts", others)
+	}
+	if r.count() != 0 {
+		t.Fatal("reconciled while the apiserver is down")
+	}
+
+	// the apiserver comes back, the next restart resumes reconciling
+	srv.setDown(false)
+	waitUntil(t, "the pod to be reconciled", r.reconciledPod("a", "x"))
+	srv.addPod("y")
+	waitUntil(t, "the added pod to be reconciled", r.reconciledPod("a", "y"))
+}
+
+func TestRestartPolicyMaxRetries(t *testing.T) {
+	srv := newPodAPIServer(t)
+	srv.setDown(true)
+	w, newCluster := newPodTestJob(t, srv, &reconcileRecorder{})
+	failures := &failureRecorder{}
+	w.AddFailedRollBack(failures.hook).WithRestartPolicy(RestartPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxRetries:     2,
+	})
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, "the watch to be given up", func() bool {
+		_, others := failures.restarts()
+		return others > 0
+	})
+	// no restart after giving up, even once the apiserver is back
+	srv.setDown(false)
+	time.Sleep(100 * time.Millisecond)
+	restarts, others := failures.restarts()
+	if len(restarts) != 2 || others != 1 {
+		t.Errorf("%d restarts and %d other failures, want the 2 restarts of MaxRetries, then the failure", len(restarts), others)
+	}
+}
+
+func TestRestartPolicyResetAfter(t *testing.T) {
+	srv := newPodAPIServer(t)
+	srv.setDown(true)
+	// every watch runs longer than ResetAfter before it fails
+	srv.delay = int64(60 * time.Millisecond)
+	w, newCluster := newPodTestJob(t, srv, &reconcileRecorder{})
+	failures := &failureRecorder{}
+	w.AddFailedRollBack(failures.hook).WithRestartPolicy(RestartPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		Jitter:         0.01,
+		ResetAfter:     50 * time.Millisecond,
+	})
+	if err := w.AddResourceWatch(newCluster("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, "three restarts", func() bool {
+		restarts, _ := failures.restarts()
+		return len(restarts) >= 3
+	})
+	restarts, _ := failures.restarts()
+	for _, restart := range restarts {
+		if restart.Attempt != 1 || restart.Backoff > 20*time.Millisecond {
+			t.Errorf("restart attempt %d in %s, want the backoff reset after a long run", restart.Attempt, restart.Backoff)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package manager
 import (
 	"context"
 	"fmt"
+	"k8s.io/klog/v2"
 	"sync"
 )
 
@@ -27,6 +28,8 @@ import (
 // Manager manages controllers. It starts their caches, waits for those to sync, then starts the controllers.
 type Manager struct {
 	controllers []Controller
+	caches      []Cache
+	elected     <-chan struct{}
 }
 
 // New creates a Manager.
@@ -51,11 +54,33 @@ func (m *Manager) AddController(c Controller) {
 	m.controllers = append(m.controllers, c)
 }
 
+// AddCache adds a cache to the Manager, to be started even if no controller of the Manager uses it.
+// This is useful when the cache feeds a controller started elsewhere.
+func (m *Manager) AddCache(c Cache) {
+	m.caches = append(m.caches, c)
+}
+
+// SetElected makes the Manager start its controllers only once elected is closed,
+// e.g. when the replica is elected leader. The caches are started right away, so they are warm by then.
+func (m *Manager) SetElected(elected <-chan struct{}) {
+	m.elected = elected
+}
+
 // Start gets all the unique caches of the controllers it manages, starts them,
 // then starts the controllers as soon as their respective caches are synced.
-// Start blocks until an error or stop is received.
+// Start blocks until an error or stop is received. On stop, it waits for the started controllers to return,
+// so they can drain their running work.
+// After an error, the caller must cancel ctx to stop the caches and controllers that are still running.
+// It logs with the logger of ctx.
 func (m *Manager) Start(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
 	errCh := make(chan error)
+	sendErr := func(err error) {
+		select {
+		case errCh <- err:
+		case <-ctx.Done():
+		}
+	}
 
 	wgs := make(map[Controller]*sync.WaitGroup)
 	caches := make(map[Cache][]Controller)
@@ -75,15 +100,22 @@ func (m *Manager) Start(ctx context.Context) error {
 		}
 	}
 
+	for i := range m.caches {
+		if _, ok := caches[m.caches[i]]; !ok {
+			caches[m.caches[i]] = []Controller{}
+		}
+	}
+
+	logger.V(1).Info("Starting caches", "caches", len(caches))
 	for ca, cos := range caches {
 		go func(ca Cache) {
 			if err := ca.Start(ctx); err != nil {
-				errCh <- err
+				sendErr(err)
 			}
 		}(ca)
 		go func(ca Cache, controllers []Controller) {
 			if ok := ca.WaitForCacheSync(ctx); !ok {
-				errCh <- fmt.Errorf("failed to wait for caches to sync")
+				sendErr(fmt.Errorf("failed to wait for caches to sync"))
 			}
 			for i := range controllers {
 				wgs[controllers[i]].Done()
@@ -91,18 +123,30 @@ func (m *Manager) Start(ctx context.Context) error {
 		}(ca, cos)
 	}
 
+	var started sync.WaitGroup
 	for i := range m.controllers {
 		co := m.controllers[i]
+		started.Add(1)
 		go func(co Controller) {
+			defer started.Done()
 			wgs[co].Wait()
+			if m.elected != nil {
+				select {
+				case <-m.elected:
+				case <-ctx.Done():
+					return
+				}
+			}
+			logger.V(1).Info("Caches synced, starting controller")
 			if err := co.Start(ctx); err != nil {
-				errCh <- err
+				sendErr(err)
 			}
 		}(co)
 	}
 
 	select {
 	case <-ctx.Done():
+		started.Wait()
 		return nil
 	case err := <-errCh:
 		return err
@@ -0,0 +1,123 @@
+// Package metrics defines the Prometheus metrics of the controllers and jobs, labeled by cluster and resource kind.
+// They are registered in Registry, which is served by Handler.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const (
+	// ResultSuccess, ResultError, ResultTerminalError, ResultRequeue and ResultRequeueAfter
+	// are the values of the result label of ReconcileTotal.
+	ResultSuccess       = "success"
+	ResultError         = "error"
+	ResultTerminalError = "terminal_error"
+	ResultRequeue       = "requeue"
+	ResultRequeueAfter  = "requeue_after"
+)
+
+var (
+	// Registry is the registry of the metrics of this package.
+	Registry = prometheus.NewRegistry()
+
+	// ReconcileTotal counts the reconciles by cluster, kind and result.
+	ReconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mc_controller_reconcile_total",
+		Help: "Total number of reconciles per cluster, kind and result.",
+	}, []string{"cluster", "kind", "result"})
+
+	// ReconcileDuration is the duration of the reconciles by cluster and kind.
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mc_controller_reconcile_duration_seconds",
+		Help:    "Duration of the reconciles per cluster and kind.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"cluster", "kind"})
+
+	// ReconcilePanics counts the panics of the reconcilers by cluster and kind.
+	ReconcilePanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mc_controller_reconcile_panics_total",
+		Help: "Total number of panics of the reconcilers per cluster and kind.",
+	}, []string{"cluster", "kind"})
+
+	// WorkqueueDepth is the number of Requests waiting in the queues, by cluster and kind.
+	WorkqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mc_workqueue_depth",
+		Help: "Number of Requests waiting to be processed per cluster and kind.",
+	}, []string{"cluster", "kind"})
+
+	// WorkqueueAdds counts the Requests added to the queues, by cluster and kind.
+	WorkqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mc_workqueue_adds_total",
+		Help: "Total number of Requests added to the queues per cluster and kind.",
+	}, []string{"cluster", "kind"})
+
+	// WorkqueueLatency is how long Requests wait in the queues before being processed, by cluster and kind.
+	WorkqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mc_workqueue_queue_duration_seconds",
+		Help:    "How long Requests wait in the queues before being processed per cluster and kind.",
+		Buckets: prometheus.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"cluster", "kind"})
+
+	// WorkqueueRetries counts the Requests requeued with a delay, by cluster and kind.
+	WorkqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mc_workqueue_retries_total",
+		Help: "Total number of Requests requeued with a delay per cluster and kind.",
+	}, []string{"cluster", "kind"})
+
+	// CacheSyncDuration is the time it takes for the caches to sync, by cluster and kind.
+	CacheSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mc_cache_sync_duration_seconds",
+		Help:    "Time it takes for the caches to sync per cluster and kind.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"cluster", "kind"})
+
+	// ClusterHealthState is 1 for the current health state of each cluster, and 0 for its other states.
+	ClusterHealthState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mc_cluster_health_state",
+		Help: "Health state of the clusters, 1 for the current state and 0 for the others.",
+	}, []string{"cluster", "state"})
+)
+
+func init() {
+	Registry.MustRegister(
+		ReconcileTotal,
+		ReconcileDuration,
+		ReconcilePanics,
+		WorkqueueDepth,
+		WorkqueueAdds,
+		WorkqueueLatency,
+		WorkqueueRetries,
+		CacheSyncDuration,
+		ClusterHealthState,
+	)
+}
+
+// reconcileResults are the values of the result label of ReconcileTotal.
+var reconcileResults = []string{ResultSuccess, ResultError, ResultTerminalError, ResultRequeue, ResultRequeueAfter}
+
+// DeleteClusterSeries deletes the series of a cluster and kind from the metrics labeled by cluster and kind,
+// once the cluster is no longer watched. ClusterHealthState is left to its own owner.
+// This version of client_golang cannot delete by partial label match, so every label combination is deleted.
+func DeleteClusterSeries(cluster, kind string) {
+	for _, result := range reconcileResults {
+		ReconcileTotal.DeleteLabelValues(cluster, kind, result)
+	}
+	for _, vec := range []interface{ DeleteLabelValues(...string) bool }{
+		ReconcileDuration,
+		ReconcilePanics,
+		WorkqueueDepth,
+		WorkqueueAdds,
+		WorkqueueLatency,
+		WorkqueueRetries,
+		CacheSyncDuration,
+	} {
+		vec.DeleteLabelValues(cluster, kind)
+	}
+}
+
+// Handler serves the metrics of Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
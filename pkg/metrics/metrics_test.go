@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns the metrics served by Handler.
+func scrape(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHandler(t *testing.T) {
+	ReconcileTotal.WithLabelValues("a", "Pod", ResultSuccess).Inc()
+	ReconcileTotal.WithLabelValues("a", "Pod", ResultTerminalError).Inc()
+	ReconcileDuration.WithLabelValues("a", "Pod").Observe(0.01)
+	ReconcilePanics.WithLabelValues("a", "Pod").Inc()
+	WorkqueueDepth.WithLabelValues("a", "Pod").Set(3)
+	WorkqueueAdds.WithLabelValues("a", "Pod").Inc()
+	WorkqueueLatency.WithLabelValues("a", "Pod").Observe(0.001)
+	WorkqueueRetries.WithLabelValues("a", "Pod").Inc()
+	CacheSyncDuration.WithLabelValues("a", "Pod").Observe(1)
+	ClusterHealthState.WithLabelValues("a", "Synced").Set(1)
+
+	body := scrape(t)
+	for _, want := range []string{
+		`mc_controller_reconcile_total{cluster="a",kind="Pod",result="success"} 1`,
+		`mc_controller_reconcile_total{cluster="a",kind="Pod",result="terminal_error"} 1`,
+		`mc_controller_reconcile_duration_seconds_count{cluster="a",kind="Pod"} 1`,
+		`mc_controller_reconcile_panics_total{cluster="a",kind="Pod"} 1`,
+		`mc_workqueue_depth{cluster="a",kind="Pod"} 3`,
+		`mc_workqueue_adds_total{cluster="a",kind="Pod"} 1`,
+		`mc_workqueue_queue_duration_seconds_count{cluster="a",kind="Pod"} 1`,
+		`mc_workqueue_retries_total{cluster="a",kind="Pod"} 1`,
+		`mc_cache_sync_duration_seconds_count{cluster="a",kind="Pod"} 1`,
+		`mc_cluster_health_state{cluster="a",state="Synced"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scraped metrics miss %s", want)
+		}
+	}
+
+	ClusterHealthState.DeleteLabelValues("a", "Synced")
+	if body := scrape(t); strings.Contains(body, `mc_cluster_health_state{cluster="a"`) {
+		t.Error("a deleted series must no longer be scraped")
+	}
+}
+
+func TestDeleteClusterSeries(t *testing.T) {
+	for _, cluster := range []string{"deleted", "kept"} {
+		for _, result := range reconcileResults {
+			ReconcileTotal.WithLabelValues(cluster, "Pod", result).Inc()
+		}
+		ReconcileDuration.WithLabelValues(cluster, "Pod").Observe(0.01)
+		ReconcilePanics.WithLabelValues(cluster, "Pod").Inc()
+		WorkqueueDepth.WithLabelValues(cluster, "Pod").Set(1)
+		WorkqueueAdds.WithLabelValues(cluster, "Pod").Inc()
+		WorkqueueLatency.WithLabelValues(cluster, "Pod").Observe(0.001)
+		WorkqueueRetries.WithLabelValues(cluster, "Pod").Inc()
+		CacheSyncDuration.WithLabelValues(cluster, "Pod").Observe(1)
+	}
+
+	DeleteClusterSeries("deleted", "Pod")
+	body := scrape(t)
+	if strings.Contains(body, `{cluster="deleted"`) {
+		t.Error("a series of the deleted cluster is still scraped")
+	}
+	// 7 series labeled by cluster and kind, one per result of ReconcileTotal
+	if n := strings.Count(body, `{cluster="kept",kind="Pod"`); n < 7+len(reconcileResults) {
+		t.Errorf("%d series of the other cluster are scraped, want them kept", n)
+	}
+}
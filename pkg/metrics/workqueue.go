@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"github.com/wangguoyan/mc-operator/pkg/reconcile"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"time"
+)
+
+// NewQueue wraps q to record the adds, depth and latency of the Requests of kind,
+// in WorkqueueAdds, WorkqueueDepth and WorkqueueLatency.
+// It is meant to be the innermost queue of a rate limiting queue, which calls Add for every delayed Request too.
+// Retries are recorded by the controllers, in WorkqueueRetries.
+func NewQueue(q workqueue.Interface, kind string) *Queue {
+	return &Queue{Interface: q, kind: kind, added: map[interface{}]time.Time{}}
+}
+
+// Queue is a workqueue.Interface recording the workqueue metrics of the Requests of a kind.
+type Queue struct {
+	workqueue.Interface
+	kind string
+
+	mu sync.Mutex
+	// added maps the Requests waiting to be processed to the time they were added,
+	// like the dirty set of workqueue.Type.
+	added map[interface{}]time.Time
+}
+
+func (q *Queue) Add(item interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.added[item]; !ok && !q.Interface.ShuttingDown() {
+		q.added[item] = time.Now()
+		cluster := ClusterOf(item)
+		WorkqueueAdds.WithLabelValues(cluster, q.kind).Inc()
+		WorkqueueDepth.WithLabelValues(cluster, q.kind).Inc()
+	}
+	q.Interface.Add(item)
+}
+
+func (q *Queue) Get() (interface{}, bool) {
+	item, shutdown := q.Interface.Get()
+	if shutdown {
+		return item, shutdown
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if added, ok := q.added[item]; ok {
+		delete(q.added, item)
+		cluster := ClusterOf(item)
+		WorkqueueDepth.WithLabelValues(cluster, q.kind).Dec()
+		WorkqueueLatency.WithLabelValues(cluster, q.kind).Observe(time.Since(added).Seconds())
+	}
+	return item, shutdown
+}
+
+// Dropped records that items were removed from the wrapped queue without being processed.
+func (q *Queue) Dropped(items ...interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range items {
+		if _, ok := q.added[item]; ok {
+			delete(q.added, item)
+			WorkqueueDepth.WithLabelValues(ClusterOf(item), q.kind).Dec()
+		}
+	}
+}
+
+// ClusterOf returns the cluster name of a reconcile.Key, or "" for other items.
+func ClusterOf(item interface{}) string {
+	if key, ok := item.(reconcile.Key); ok {
+		return key.ClusterName
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package reconcile
+
+import (
+	"errors"
+	"time"
+)
+
+// BackoffFunc returns the delay before retrying a Request that failed failures times in a row.
+type BackoffFunc func(failures int) time.Duration
+
+// ExponentialBackoff returns a BackoffFunc doubling the delay from base at every failure, up to max.
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(failures int) time.Duration {
+		d := base
+		for i := 1; i < failures && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Terminal wraps err so that the Request is never retried. The error is still logged and counted.
+func Terminal(err error) error {
+	return &terminalError{err: err}
+}
+
+// RetryAfter wraps err so that the Request is retried after d, instead of with the rate limiter of the queue.
+// If d is not positive, the Request is retried with the rate limiter of the queue, so that it does not spin.
+func RetryAfter(err error, d time.Duration) error {
+	return &retryError{err: err, backoff: func(int) time.Duration { return d }}
+}
+
+// Retryable wraps err so that the Request is retried after the delay returned by backoff,
+// given the number of times in a row the Request failed, instead of with the rate limiter of the queue.
+// If backoff is nil, or returns a delay that is not positive, the Request is retried with the rate limiter of the queue.
+func Retryable(err error, backoff BackoffFunc) error {
+	return &retryError{err: err, backoff: backoff}
+}
+
+// IsTerminal reports whether err, or an error it wraps, was returned by Terminal.
+func IsTerminal(err error) bool {
+	var t *terminalError
+	return errors.As(err, &t)
+}
+
+// RetryDelay returns the delay before retrying a Request that failed failures times in a row with err,
+// if err, or an error it wraps, was returned by RetryAfter or Retryable and sets a positive delay.
+// Otherwise the Request is retried with the rate limiter of the queue.
+func RetryDelay(err error, failures int) (time.Duration, bool) {
+	var r *retryError
+	if !errors.As(err, &r) || r.backoff == nil {
+		return 0, false
+	}
+	d := r.backoff(failures)
+	return d, d > 0
+}
+
+type terminalError struct {
+	err error
+}
+
+func (e *terminalError) Error() string {
+	if e.err == nil {
+		return "terminal error"
+	}
+	return "terminal error: " + e.err.Error()
+}
+
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
+type retryError struct {
+	err     error
+	backoff BackoffFunc
+}
+
+func (e *retryError) Error() string {
+	if e.err == nil {
+		return "retryable error"
+	}
+	return e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,92 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, 10*time.Second)
+	for failures, want := range map[int]time.Duration{
+		0:   time.Second,
+		1:   time.Second,
+		2:   2 * time.Second,
+		3:   4 * time.Second,
+		4:   8 * time.Second,
+		5:   10 * time.Second,
+		100: 10 * time.Second,
+	} {
+		if got := backoff(failures); got != want {
+			t.Errorf("delay after %d failures = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	cause := errors.New("invalid spec")
+	err := fmt.Errorf("reconcile: %w", Terminal(cause))
+	if !IsTerminal(err) {
+		t.Error("a wrapped terminal error must be terminal")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("a terminal error must wrap its cause")
+	}
+	if _, ok := RetryDelay(err, 1); ok {
+		t.Error("a terminal error has no retry delay")
+	}
+	if IsTerminal(cause) || IsTerminal(nil) {
+		t.Error("only the errors returned by Terminal are terminal")
+	}
+	if got := Terminal(nil).Error(); got != "terminal error" {
+		t.Errorf("Terminal(nil).Error() = %q", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cause := errors.New("not ready")
+	err := fmt.Errorf("reconcile: %w", RetryAfter(cause, time.Minute))
+	for _, failures := range []int{1, 5} {
+		if d, ok := RetryDelay(err, failures); !ok || d != time.Minute {
+			t.Errorf("delay after %d failures = %s, %t, want a minute", failures, d, ok)
+		}
+	}
+	if !errors.Is(err, cause) || IsTerminal(err) {
+		t.Error("a retry-after error must wrap its cause and not be terminal")
+	}
+	if err.Error() != "reconcile: not ready" {
+		t.Errorf("Error() = %q, want the message of its cause", err.Error())
+	}
+	for _, d := range []time.Duration{0, -time.Second} {
+		if _, ok := RetryDelay(RetryAfter(cause, d), 1); ok {
+			t.Errorf("RetryAfter(err, %s) has a retry delay, want the rate limiter of the queue", d)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	var seen []int
+	err := Retryable(errors.New("conflict"), func(failures int) time.Duration {
+		seen = append(seen, failures)
+		return time.Duration(failures) * time.Second
+	})
+	for _, failures := range []int{1, 2, 3} {
+		if d, ok := RetryDelay(err, failures); !ok || d != time.Duration(failures)*time.Second {
+			t.Errorf("delay after %d failures = %s, %t", failures, d, ok)
+		}
+	}
+	if fmt.Sprint(seen) != "[1 2 3]" {
+		t.Errorf("backoff called with %v, want the failures in a row", seen)
+	}
+	if _, ok := RetryDelay(errors.New("other"), 1); ok {
+		t.Error("a plain error has no retry delay")
+	}
+	if _, ok := RetryDelay(Retryable(errors.New("conflict"), nil), 1); ok {
+		t.Error("a nil backoff has no retry delay, want the rate limiter of the queue")
+	}
+	zero := Retryable(errors.New("conflict"), func(int) time.Duration { return 0 })
+	if _, ok := RetryDelay(zero, 1); ok {
+		t.Error("a zero backoff has no retry delay, want the rate limiter of the queue")
+	}
+}
@@ -17,15 +17,33 @@ limitations under the License.
 package reconcile
 
 import (
+	"context"
+	"github.com/go-logr/logr"
 	"github.com/wangguoyan/mc-operator/pkg/cluster"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// Key identifies the object to reconcile. It is comparable, and used as the workqueue key,
+// so the events of the same object in the same cluster are deduplicated,
+// whichever ClusterCache instance of the cluster they come from.
+type Key struct {
+	// ClusterName is the name of the cluster of the object.
+	ClusterName string
+	types.NamespacedName
+	// GroupVersionKind is the kind of the object. It is optional,
+	// and only needed to tell apart the objects of a queue shared by several kinds.
+	GroupVersionKind schema.GroupVersionKind
+}
+
+// Request is given to the Reconcilers: the Key of the object to reconcile,
+// and its cluster, resolved by the Controller from the clusters it watches when the Request is reconciled.
 type Request struct {
+	Key
 	Cluster cluster.ClusterCache
-	types.NamespacedName
 }
 
 func (r Request) GetClient() client.Client {
@@ -37,7 +55,14 @@ func (r Request) GetClient() client.Client {
 }
 
 func (r Request) GetClusterName() string {
-	return r.Cluster.GetClusterName()
+	return r.ClusterName
+}
+
+// LoggerFrom returns the logger of a reconcile context, with the cluster, namespace and name of the Request
+// and the GroupVersionKind of the reconciled resource, if known.
+// It returns klog's global logger if ctx has no logger.
+func LoggerFrom(ctx context.Context) logr.Logger {
+	return klog.FromContext(ctx)
 }
 
 // Result is the return type of a Reconciler's Reconcile method.
@@ -46,6 +71,29 @@ func (r Request) GetClusterName() string {
 type Result = reconcile.Result
 
 // Reconciler is the interface used by a Controller to reconcile.
+// Prefer ContextReconciler, Reconciler is adapted to it with AsContextReconciler.
 type Reconciler interface {
 	Reconcile(Request) (Result, error)
 }
+
+// ContextReconciler is the interface used by a Controller to reconcile with a context.
+// The context is cancelled once the grace period of the Controller has expired after the cluster of the Request
+// is no longer watched or the Controller is stopped, or when the reconcile times out.
+type ContextReconciler interface {
+	Reconcile(context.Context, Request) (Result, error)
+}
+
+// Func is a ContextReconciler implemented by a function.
+type Func func(context.Context, Request) (Result, error)
+
+// Reconcile implements ContextReconciler.
+func (f Func) Reconcile(ctx context.Context, req Request) (Result, error) {
+	return f(ctx, req)
+}
+
+// AsContextReconciler adapts a Reconciler to a ContextReconciler ignoring the context.
+func AsContextReconciler(r Reconciler) ContextReconciler {
+	return Func(func(_ context.Context, req Request) (Result, error) {
+		return r.Reconcile(req)
+	})
+}
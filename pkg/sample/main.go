@@ -10,15 +10,14 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
-	"log"
 	"time"
 )
 
 func main() {
 	watchResources := []*job.WatchResource{
 		{
-			ObjectType: &v1.Deployment{},
-			Reconciler: &testReconciler{},
+			ObjectType:        &v1.Deployment{},
+			ContextReconciler: &testReconciler{},
 			//Scheme: APi.Scheme, 自定义crd
 			Owner: &job.Owner{
 				ObjectType:   &v1.ReplicaSet{},
@@ -32,29 +31,36 @@ func main() {
 		return
 	}
 	watchJob.AddFailedRollBack(func(clusterName string, err error) {
-		klog.Infof("cluster %s watch error : %s", clusterName, err.Error())
+		klog.Background().Error(err, "Cluster watch failed", "cluster", clusterName)
 	})
 
+	// 每个kubeconfig上下文对应一个集群, 默认读取KUBECONFIG或~/.kube/config
+	clusters, err := job.NewClustersFromKubeconfig()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if len(clusters) == 0 {
+		fmt.Println("no context in kubeconfig")
+		return
+	}
+
 	go func() {
 		time.Sleep(15 * time.Second)
 		// 停止监听指定集群
-		watchJob.StopResourceWatch(job.NewClusterDefault("test"))
-		go func() {
-			time.Sleep(15 * time.Second)
-			watchJob.StopResourceWatch(job.NewClusterDefault("test2"))
-		}()
+		watchJob.StopResourceWatch(clusters[0])
 	}()
 	// 开始监听指定集群
-	watchJob.StartResourceWatch(job.NewClusterDefault("test"), job.NewClusterDefault("test2"))
+	watchJob.StartResourceWatch(clusters...)
 }
 
 type testReconciler struct {
 }
 
-func (r *testReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+func (r *testReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 
 	obj := &v1.Deployment{}
-	err := req.GetClient().Get(context.TODO(), types.NamespacedName{
+	err := req.GetClient().Get(ctx, types.NamespacedName{
 		Namespace: req.Namespace,
 		Name:      req.Name,
 	}, obj)
@@ -64,6 +70,6 @@ func (r *testReconciler) Reconcile(req reconcile.Request) (reconcile.Result, err
 		}
 		return reconcile.Result{}, err
 	}
-	log.Printf("%s / %s /%s /%s", req.Cluster.GetClusterName(), obj.GetName(), obj.GetNamespace(), obj.UID)
+	reconcile.LoggerFrom(ctx).Info("Reconciled", "uid", obj.UID)
 	return reconcile.Result{}, nil
 }
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// HashRing assigns keys to members by consistent hashing. Every member is placed on the ring
+// at several virtual nodes, so keys are spread evenly, and only the keys of a member that joins
+// or leaves move to another member.
+type HashRing struct {
+	hashes  []uint64
+	members map[uint64]string
+}
+
+// NewHashRing creates a ring of the given members, each with virtualNodes virtual nodes.
+func NewHashRing(virtualNodes int, members ...string) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = 1
+	}
+	r := &HashRing{members: map[uint64]string{}}
+	for _, m := range members {
+		for i := 0; i < virtualNodes; i++ {
+			h := hashKey(m + "#" + strconv.Itoa(i))
+			if owner, ok := r.members[h]; ok && owner < m {
+				// keep the assignment of colliding virtual nodes independent of the order of the members
+				continue
+			}
+			if _, ok := r.members[h]; !ok {
+				r.hashes = append(r.hashes, h)
+			}
+			r.members[h] = m
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Get returns the member owning key, or "" if the ring has no member.
+func (r *HashRing) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.members[r.hashes[i]]
+}
+
+// hashKey hashes key with FNV-1a, then mixes the bits with the finalizer of MurmurHash3,
+// as FNV alone spreads similar keys such as the virtual nodes of a member poorly.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("cluster-%d", i)
+	}
+	return keys
+}
+
+// assign returns the owner of every key on the ring.
+func assign(r *HashRing, keys []string) map[string]string {
+	owners := map[string]string{}
+	for _, k := range keys {
+		owners[k] = r.Get(k)
+	}
+	return owners
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	if got := NewHashRing(10).Get("a"); got != "" {
+		t.Errorf("owner on an empty ring = %q", got)
+	}
+}
+
+func TestHashRingSpread(t *testing.T) {
+	keys := ringKeys(3000)
+	counts := map[string]int{}
+	for _, owner := range assign(NewHashRing(100, "a", "b", "c"), keys) {
+		counts[owner]++
+	}
+	for _, m := range []string{"a", "b", "c"} {
+		// a third each, give or take a third of it
+		if counts[m] < 670 || counts[m] > 1330 {
+			t.Errorf("member %s owns %d of %d keys: %v", m, counts[m], len(keys), counts)
+		}
+	}
+}
+
+func TestHashRingOrderIndependent(t *testing.T) {
+	keys := ringKeys(1000)
+	a, b := assign(NewHashRing(100, "a", "b", "c"), keys), assign(NewHashRing(100, "c", "a", "b"), keys)
+	for _, k := range keys {
+		if a[k] != b[k] {
+			t.Fatalf("key %s owned by %s or %s depending on the order of the members", k, a[k], b[k])
+		}
+	}
+}
+
+func TestHashRingMinimalMoves(t *testing.T) {
+	keys := ringKeys(3000)
+	before := assign(NewHashRing(100, "a", "b", "c"), keys)
+
+	// a member joins: only the keys it takes move, about a quarter of them
+	joined := assign(NewHashRing(100, "a", "b", "c", "d"), keys)
+	moved := 0
+	for _, k := range keys {
+		if joined[k] != before[k] {
+			moved++
+			if joined[k] != "d" {
+				t.Fatalf("key %s moved from %s to %s, not to the new member", k, before[k], joined[k])
+			}
+		}
+	}
+	if moved < len(keys)/8 || moved > len(keys)*3/8 {
+		t.Errorf("%d of %d keys moved to the new member, want about a quarter", moved, len(keys))
+	}
+
+	// a member leaves: only its keys move
+	left := assign(NewHashRing(100, "a", "c"), keys)
+	for _, k := range keys {
+		if before[k] != "b" && left[k] != before[k] {
+			t.Fatalf("key %s moved from %s to %s, though its owner stayed", k, before[k], left[k])
+		}
+		if left[k] == "b" {
+			t.Fatalf("key %s still owned by the member that left", k)
+		}
+	}
+}
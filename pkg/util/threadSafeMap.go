@@ -9,9 +9,6 @@ type ThreadSafeMap struct {
 
 func (t *ThreadSafeMap) Load(i interface{}) (interface{}, bool) {
 	t.mu.RLock()
-	if t.values == nil {
-		t.values = map[interface{}]interface{}{}
-	}
 	v, ok := t.values[i]
 	t.mu.RUnlock()
 	return v, ok
@@ -26,17 +23,68 @@ func (t *ThreadSafeMap) Store(key, value interface{}) {
 	t.mu.Unlock()
 }
 
+// LoadOrStore returns the existing value for the key if present.
+// Otherwise, it stores and returns the given value. The loaded result is true if the value was loaded.
+func (t *ThreadSafeMap) LoadOrStore(key, value interface{}) (actual interface{}, loaded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.values[key]; ok {
+		return v, true
+	}
+	if t.values == nil {
+		t.values = map[interface{}]interface{}{}
+	}
+	t.values[key] = value
+	return value, false
+}
+
+// LoadAndDelete deletes the value for a key, returning the previous value if any.
+func (t *ThreadSafeMap) LoadAndDelete(key interface{}) (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.values[key]
+	delete(t.values, key)
+	return v, ok
+}
+
+// CompareAndDelete deletes the value for a key if it is old. It reports whether the value was deleted.
+// Values are compared with ==, so they must be comparable.
+func (t *ThreadSafeMap) CompareAndDelete(key, old interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.values[key]; !ok || v != old {
+		return false
+	}
+	delete(t.values, key)
+	return true
+}
+
 func (t *ThreadSafeMap) Delete(i interface{}) {
+	t.mu.Lock()
 	delete(t.values, i)
+	t.mu.Unlock()
 }
 
 func (t *ThreadSafeMap) Size() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return len(t.values)
 }
 
+// Range calls f for each key and value, until f returns false.
+// It ranges over a snapshot of the map, so f can modify the map.
 func (t *ThreadSafeMap) Range(f func(key interface{}, value interface{}) (shouldContinue bool)) {
+	t.mu.RLock()
+	keys := make([]interface{}, 0, len(t.values))
+	values := make([]interface{}, 0, len(t.values))
 	for k, v := range t.values {
-		shouldContinue := f(k, v)
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	t.mu.RUnlock()
+
+	for i := range keys {
+		shouldContinue := f(keys[i], values[i])
 		if !shouldContinue {
 			return
 		}